@@ -0,0 +1,262 @@
+package dsent
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// ErrAuditDisabled is returned by History when the DSEnt does not use WithAudit.
+var ErrAuditDisabled = errors.New("audit is not enabled")
+
+// actorKey is the context key of the actor of the writes.
+type actorKey struct{}
+
+// WithActor returns a copy of ctx carrying the actor recorded in the audit
+// entries of the writes made with it, e.g. the ID of the authenticated user.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns the actor set with WithActor, or an empty string.
+func ActorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// AuditEntry records a write of an entity, see WithAudit.
+type AuditEntry struct {
+	// ID is the ID of the audit entity.
+	ID int64
+	// Kind and Key identify the written entity.
+	Kind string
+	Key  *datastore.Key
+	Op   MutationOp
+	// Actor is the actor of the context of the write, see WithActor.
+	Actor string
+	Time  time.Time
+	// Before and After are the properties of the entity before and after the
+	// write. Before is nil for creates, After is nil for deletes.
+	Before []datastore.Property
+	After  []datastore.Property
+}
+
+func (e *AuditEntry) LoadKey(k *datastore.Key) error {
+	e.ID = k.ID
+	return nil
+}
+
+func (e *AuditEntry) Load(ps []datastore.Property) error {
+	for _, p := range ps {
+		switch v := p.Value.(type) {
+		case string:
+			switch p.Name {
+			case "kind":
+				e.Kind = v
+			case "op":
+				e.Op = parseMutationOp(v)
+			case "actor":
+				e.Actor = v
+			}
+		case *datastore.Key:
+			if p.Name == "key" {
+				e.Key = v
+			}
+		case time.Time:
+			if p.Name == "time" {
+				e.Time = v
+			}
+		case *datastore.Entity:
+			switch p.Name {
+			case "before":
+				e.Before = v.Properties
+			case "after":
+				e.After = v.Properties
+			}
+		}
+	}
+	return nil
+}
+
+func (e *AuditEntry) Save() ([]datastore.Property, error) {
+	ps := []datastore.Property{
+		{Name: "kind", Value: e.Kind},
+		{Name: "key", Value: e.Key},
+		{Name: "op", Value: e.Op.String()},
+		{Name: "actor", Value: e.Actor},
+		{Name: "time", Value: e.Time},
+	}
+	if e.Before != nil {
+		ps = append(ps, datastore.Property{Name: "before", Value: &datastore.Entity{Properties: e.Before}, NoIndex: true})
+	}
+	if e.After != nil {
+		ps = append(ps, datastore.Property{Name: "after", Value: &datastore.Entity{Properties: e.After}, NoIndex: true})
+	}
+	return ps, nil
+}
+
+// parseMutationOp is the inverse of MutationOp.String.
+func parseMutationOp(s string) MutationOp {
+	for op := OpInsert; op <= OpDelete; op++ {
+		if op.String() == s {
+			return op
+		}
+	}
+	return 0
+}
+
+// audited reports whether the DSEnt audits its writes.
+func (db *DSEnt[T]) audited() bool {
+	return db.opts.auditKind != ""
+}
+
+// mutationLimit is the number of entities that can be written in a single
+// transaction, leaving room for their audit entities.
+func (db *DSEnt[T]) mutationLimit() int {
+	if db.audited() {
+		return MaxMutations / 2
+	}
+	return MaxMutations
+}
+
+// allocateTx replaces the incomplete keys with keys allocated by the backend,
+// if the DSEnt audits its writes, so that the audit entries of the entities
+// created with incomplete keys record their complete key.
+func (db *DSEnt[T]) allocateTx(tx Tx, keys []*datastore.Key) error {
+	if !db.audited() {
+		return nil
+	}
+	var incomplete []*datastore.Key
+	var index []int
+	for i, key := range keys {
+		if key.Incomplete() {
+			incomplete = append(incomplete, key)
+			index = append(index, i)
+		}
+	}
+	if len(incomplete) == 0 {
+		return nil
+	}
+	allocated, err := db.backend.AllocateIDs(tx.Context(), incomplete)
+	if err != nil {
+		return err
+	}
+	for j, i := range index {
+		keys[i] = allocated[j]
+	}
+	return nil
+}
+
+// snapshotTx returns the properties of the entities stored for keys within tx,
+// nil for those that do not exist, if the DSEnt audits its writes.
+func (db *DSEnt[T]) snapshotTx(tx Tx, keys []*datastore.Key) ([][]datastore.Property, error) {
+	if !db.audited() {
+		return nil, nil
+	}
+	return db.readTx(tx, keys)
+}
+
+// readTx returns the properties of the entities stored for keys within tx,
+// nil for those that do not exist or whose key is incomplete.
+func (db *DSEnt[T]) readTx(tx Tx, keys []*datastore.Key) ([][]datastore.Property, error) {
+	snapshots := make([][]datastore.Property, len(keys))
+	var complete []*datastore.Key
+	var index []int
+	for i, key := range keys {
+		if !key.Incomplete() {
+			complete = append(complete, key)
+			index = append(index, i)
+		}
+	}
+	if len(complete) == 0 {
+		return snapshots, nil
+	}
+	props := make([]datastore.PropertyList, len(complete))
+	err := tx.GetMulti(complete, props)
+	merr, _ := err.(datastore.MultiError)
+	if err != nil && merr == nil {
+		return nil, err
+	}
+	for i, ps := range props {
+		if merr != nil && merr[i] == datastore.ErrNoSuchEntity {
+			continue
+		} else if merr != nil && merr[i] != nil {
+			return nil, merr[i]
+		}
+		snapshots[index[i]] = ps
+	}
+	return snapshots, nil
+}
+
+// auditTx stages an audit entity for every write of an entity within tx, if the
+// DSEnt audits its writes. before are the snapshots of the entities taken with
+// snapshotTx, or nil, and after the written objects, or nil for deletes.
+// Deletes of entities that did not exist are not recorded.
+func (db *DSEnt[T]) auditTx(tx Tx, op MutationOp, keys []*datastore.Key, before [][]datastore.Property, after []T) error {
+	if !db.audited() {
+		return nil
+	}
+	actor := ActorFromContext(tx.Context())
+	now := db.opts.now().Truncate(time.Microsecond)
+	var muts []*Mutation
+	for i, key := range keys {
+		e := &AuditEntry{Kind: db.kind, Key: key, Op: op, Actor: actor, Time: now}
+		if before != nil {
+			e.Before = before[i]
+		}
+		if after != nil {
+			ps, err := after[i].Save()
+			if err != nil {
+				return err
+			}
+			e.After = ps
+		}
+		if e.Before == nil && e.After == nil {
+			continue
+		}
+		auditKey := datastore.IncompleteKey(db.opts.auditKind, nil)
+		auditKey.Namespace = db.namespace
+		muts = append(muts, NewInsert(auditKey, e))
+	}
+	if len(muts) == 0 {
+		return nil
+	}
+	_, err := tx.Mutate(muts...)
+	return err
+}
+
+// History returns the audit entries of the entity of obj, oldest first.
+//
+// Entries are matched on their "key" property only, so that no composite
+// index is needed, and sorted by time.
+func (db *DSEnt[T]) History(ctx context.Context, obj T) (_ []*AuditEntry, err error) {
+	ctx, span := db.startSpan(ctx, "History", -1)
+	defer endSpan(span, &err)
+	if !db.audited() {
+		return nil, ErrAuditDisabled
+	}
+	key, err := obj.BuildKey(db.namespace)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*AuditEntry
+	if _, err := db.backend.GetAll(ctx, &QuerySpec{
+		Kind:      db.opts.auditKind,
+		Namespace: db.namespace,
+		Filters:   []Filter{{Field: "key", Op: "=", Value: key}},
+		Limit:     -1,
+	}, &entries); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if !entries[i].Time.Equal(entries[j].Time) {
+			return entries[i].Time.Before(entries[j].Time)
+		}
+		return entries[i].ID < entries[j].ID
+	})
+	span.SetAttributes(attrBatchSize.Int(len(entries)))
+	return entries, nil
+}
@@ -0,0 +1,151 @@
+package dsent
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+// auditNames returns the value of the "name" property of every snapshot.
+func auditNames(snapshots ...[]datastore.Property) []interface{} {
+	names := make([]interface{}, len(snapshots))
+	for i, ps := range snapshots {
+		for _, p := range ps {
+			if p.Name == "name" {
+				names[i] = p.Value
+			}
+		}
+	}
+	return names
+}
+
+func TestAudit(t *testing.T) {
+	ctx := WithActor(context.Background(), "alice")
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	db := newMemoryDSEnt[*memoryObj](t, "Memory", WithAudit("Audit"), WithClock(func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}))
+
+	_, _, err := db.Create(ctx, &memoryObj{ID: 1, Name: "a"})
+	require.NoError(t, err)
+	_, _, err = db.Put(ctx, &memoryObj{ID: 1, Name: "b"})
+	require.NoError(t, err)
+	_, err = db.Update(WithActor(ctx, "bob"), &memoryObj{ID: 1}, func(obj *memoryObj) (*memoryObj, error) {
+		obj.Name = "c"
+		return obj, nil
+	}, nil)
+	require.NoError(t, err)
+	require.NoError(t, db.Delete(ctx, &memoryObj{ID: 1}))
+	// deleting an entity that does not exist is not recorded
+	require.NoError(t, db.Delete(ctx, &memoryObj{ID: 1}))
+
+	entries, err := db.History(ctx, &memoryObj{ID: 1})
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+	var ops []MutationOp
+	var actors []string
+	for i, e := range entries {
+		ops = append(ops, e.Op)
+		actors = append(actors, e.Actor)
+		require.Equal(t, "Memory", e.Kind)
+		require.Equal(t, int64(1), e.Key.ID)
+		require.NotZero(t, e.ID)
+		if i > 0 {
+			require.True(t, e.Time.After(entries[i-1].Time))
+		}
+	}
+	require.Equal(t, []MutationOp{OpInsert, OpUpsert, OpUpdate, OpDelete}, ops)
+	require.Equal(t, []string{"alice", "alice", "bob", "alice"}, actors)
+	require.Nil(t, entries[0].Before)
+	require.Equal(t, []interface{}{"a", "b", "c"}, auditNames(entries[1].Before, entries[2].Before, entries[3].Before))
+	require.Equal(t, []interface{}{"a", "b", "c"}, auditNames(entries[0].After, entries[1].After, entries[2].After))
+	require.Nil(t, entries[3].After)
+
+	// the entries of other entities are not returned
+	_, _, err = db.BatchPut(ctx, []*memoryObj{{ID: 2, Name: "x"}, {ID: 3, Name: "y"}})
+	require.NoError(t, err)
+	entries, err = db.History(ctx, &memoryObj{ID: 2})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Nil(t, entries[0].Before)
+
+	// nothing is recorded if the transaction fails
+	errAbort := errors.New("abort")
+	_, err = db.RunInTransaction(ctx, func(tx Tx) error {
+		if _, _, err := db.PutTx(tx, &memoryObj{ID: 2, Name: "z"}); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	require.ErrorIs(t, err, errAbort)
+	entries, err = db.History(ctx, &memoryObj{ID: 2})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	// bulk writes are recorded too
+	require.NoError(t, db.BulkDelete(ctx, []*memoryObj{{ID: 2}, {ID: 3}}, WithChunkSize(1)))
+	entries, err = db.History(ctx, &memoryObj{ID: 3})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, OpDelete, entries[1].Op)
+	require.Equal(t, []interface{}{"y"}, auditNames(entries[1].Before))
+}
+
+func TestAuditSoftDelete(t *testing.T) {
+	ctx := context.Background()
+	db := newMemoryDSEnt[*softObj](t, "Soft", WithAudit("Audit"), WithSoftDelete("deleted_at"))
+
+	_, _, err := db.Create(ctx, &softObj{ID: 1, Name: "a"})
+	require.NoError(t, err)
+	require.NoError(t, db.Delete(ctx, &softObj{ID: 1}))
+	_, err = db.Restore(ctx, &softObj{ID: 1})
+	require.NoError(t, err)
+	require.NoError(t, db.Purge(ctx, &softObj{ID: 1}))
+
+	entries, err := db.History(ctx, &softObj{ID: 1})
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+	var ops []MutationOp
+	for _, e := range entries {
+		ops = append(ops, e.Op)
+	}
+	require.Equal(t, []MutationOp{OpInsert, OpDelete, OpUpdate, OpDelete}, ops)
+	// a soft delete records the marked entity
+	require.Equal(t, []interface{}{"a"}, auditNames(entries[1].After))
+	require.Nil(t, entries[3].After)
+}
+
+func TestAuditDisabled(t *testing.T) {
+	db := newMemoryDSEnt[*memoryObj](t, "Memory")
+	_, err := db.History(context.Background(), &memoryObj{ID: 1})
+	require.ErrorIs(t, err, ErrAuditDisabled)
+}
+
+func TestAuditIncompleteKey(t *testing.T) {
+	ctx := context.Background()
+	db := newMemoryDSEnt[*memoryObj](t, "Memory", WithAudit("Audit"))
+
+	// the entries of entities created with incomplete keys record their allocated key
+	key, obj, err := db.Create(ctx, &memoryObj{Name: "a"})
+	require.NoError(t, err)
+	require.False(t, key.Incomplete())
+	require.Equal(t, key.ID, obj.ID)
+	_, objs, err := db.BulkCreate(ctx, []*memoryObj{{Name: "b"}, {Name: "c"}})
+	require.NoError(t, err)
+	require.NotEqual(t, objs[0].ID, objs[1].ID)
+	require.NotEqual(t, obj.ID, objs[0].ID)
+
+	for _, obj := range append(objs, obj) {
+		entries, err := db.History(ctx, obj)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		require.Equal(t, OpInsert, entries[0].Op)
+		require.Equal(t, obj.ID, entries[0].Key.ID)
+		require.Equal(t, []interface{}{obj.Name}, auditNames(entries[0].After))
+	}
+}
@@ -0,0 +1,354 @@
+package dsent
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// MutationOp is the operation performed by a Mutation.
+type MutationOp int
+
+const (
+	// OpInsert creates an entity, it fails if the entity already exists.
+	OpInsert MutationOp = iota + 1
+	// OpUpsert creates or replaces an entity.
+	OpUpsert
+	// OpUpdate replaces an entity, it fails if the entity does not exist.
+	OpUpdate
+	// OpDelete deletes an entity, if it exists.
+	OpDelete
+)
+
+func (op MutationOp) String() string {
+	switch op {
+	case OpInsert:
+		return "insert"
+	case OpUpsert:
+		return "upsert"
+	case OpUpdate:
+		return "update"
+	case OpDelete:
+		return "delete"
+	default:
+		return fmt.Sprintf("MutationOp(%d)", int(op))
+	}
+}
+
+// Mutation is a backend-agnostic write of a single entity.
+type Mutation struct {
+	Op  MutationOp
+	Key *datastore.Key
+	// Src is the entity to write, it is nil for OpDelete.
+	Src datastore.PropertyLoadSaver
+}
+
+// NewInsert creates an insert mutation.
+func NewInsert(key *datastore.Key, src datastore.PropertyLoadSaver) *Mutation {
+	return &Mutation{Op: OpInsert, Key: key, Src: src}
+}
+
+// NewUpsert creates an upsert mutation.
+func NewUpsert(key *datastore.Key, src datastore.PropertyLoadSaver) *Mutation {
+	return &Mutation{Op: OpUpsert, Key: key, Src: src}
+}
+
+// NewUpdate creates an update mutation.
+func NewUpdate(key *datastore.Key, src datastore.PropertyLoadSaver) *Mutation {
+	return &Mutation{Op: OpUpdate, Key: key, Src: src}
+}
+
+// NewDelete creates a delete mutation.
+func NewDelete(key *datastore.Key) *Mutation {
+	return &Mutation{Op: OpDelete, Key: key}
+}
+
+// PendingKey is the key of an entity written within a transaction.
+// It can only be resolved to a complete key by the Commit of the transaction.
+type PendingKey struct {
+	ref interface{}
+}
+
+// NewPendingKey creates a PendingKey holding a backend-specific reference.
+// It is meant for Backend implementations.
+func NewPendingKey(ref interface{}) *PendingKey {
+	return &PendingKey{ref: ref}
+}
+
+// Ref returns the backend-specific reference of the pending key.
+func (pk *PendingKey) Ref() interface{} {
+	return pk.ref
+}
+
+// Commit is a committed transaction.
+type Commit interface {
+	// Key resolves a pending key of the transaction into a complete key.
+	Key(pk *PendingKey) *datastore.Key
+}
+
+// Tx is a transaction opened by a Backend.
+//
+// The *Tx methods of DSEnt take a Tx, use DSEnt.RunInTransaction to get one,
+// or NewClientTx to wrap a Datastore transaction opened by the caller.
+// Like Datastore transactions, reads do not observe the writes of the same transaction.
+type Tx interface {
+	// Context returns the context the transaction was started with.
+	Context() context.Context
+	// Get loads the entity stored for key into dst.
+	Get(key *datastore.Key, dst interface{}) error
+	// GetMulti is a batch version of Get, dst must be a slice of the same length as keys.
+	GetMulti(keys []*datastore.Key, dst interface{}) error
+	// Mutate stages mutations to be applied when the transaction commits.
+	Mutate(muts ...*Mutation) ([]*PendingKey, error)
+	// GetAll runs a query within the transaction, see Backend.GetAll.
+	GetAll(q *QuerySpec, dst interface{}) ([]*datastore.Key, error)
+}
+
+// Backend is the storage DSEnt runs against.
+//
+// Loading and saving go through datastore.PropertyLoadSaver: the dst
+// arguments are PropertyLoadSavers, slices of them, or pointers to such
+// slices for queries, as with the Datastore client.
+type Backend interface {
+	// Get loads the entity stored for key into dst.
+	// It returns datastore.ErrNoSuchEntity if there is no such entity.
+	Get(ctx context.Context, key *datastore.Key, dst interface{}) error
+	// GetMulti is a batch version of Get, dst must be a slice of the same length as keys.
+	// Errors are reported with a datastore.MultiError.
+	GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error
+	// Mutate applies mutations non-transactionally and returns the complete keys.
+	Mutate(ctx context.Context, muts ...*Mutation) ([]*datastore.Key, error)
+	// RunInTransaction runs f in a transaction and commits it if f returns nil.
+	RunInTransaction(ctx context.Context, f func(tx Tx) error, opts ...datastore.TransactionOption) (Commit, error)
+	// GetAll runs a query and loads the results into dst, which must be a pointer
+	// to a slice, or nil for keys-only queries.
+	GetAll(ctx context.Context, q *QuerySpec, dst interface{}) ([]*datastore.Key, error)
+	// Run is like GetAll, but also returns the cursor following the last result.
+	Run(ctx context.Context, q *QuerySpec, dst interface{}) ([]*datastore.Key, datastore.Cursor, error)
+	// Count returns the number of results of a query.
+	Count(ctx context.Context, q *QuerySpec) (int, error)
+	// AllocateIDs returns complete keys for incomplete keys, with IDs that are
+	// not used by other entities.
+	AllocateIDs(ctx context.Context, keys []*datastore.Key) ([]*datastore.Key, error)
+	// Close releases the resources of the backend.
+	Close() error
+}
+
+// clientBackend is the Backend backed by a Datastore client.
+type clientBackend struct {
+	client *datastore.Client
+}
+
+// NewClientBackend creates a Backend that runs against Datastore with the given client.
+func NewClientBackend(client *datastore.Client) Backend {
+	return &clientBackend{client: client}
+}
+
+// identity returns the client, so that the backends of the same client share
+// their transactions, see backendIdentity.
+func (b *clientBackend) identity() interface{} {
+	return b.client
+}
+
+// backendIdentity returns the value identifying the storage b runs against:
+// the client of the backends created by NewClientBackend, or b itself.
+func backendIdentity(b Backend) interface{} {
+	if ib, ok := b.(interface{ identity() interface{} }); ok {
+		return ib.identity()
+	}
+	return b
+}
+
+// datastoreMutations converts mutations into Datastore mutations.
+func datastoreMutations(muts []*Mutation) ([]*datastore.Mutation, error) {
+	dmuts := make([]*datastore.Mutation, len(muts))
+	for i, mut := range muts {
+		switch mut.Op {
+		case OpInsert:
+			dmuts[i] = datastore.NewInsert(mut.Key, mut.Src)
+		case OpUpsert:
+			dmuts[i] = datastore.NewUpsert(mut.Key, mut.Src)
+		case OpUpdate:
+			dmuts[i] = datastore.NewUpdate(mut.Key, mut.Src)
+		case OpDelete:
+			dmuts[i] = datastore.NewDelete(mut.Key)
+		default:
+			return nil, fmt.Errorf("invalid mutation: %s", mut.Op)
+		}
+	}
+	return dmuts, nil
+}
+
+func (b *clientBackend) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	return b.client.Get(ctx, key, dst)
+}
+
+func (b *clientBackend) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	return b.client.GetMulti(ctx, keys, dst)
+}
+
+func (b *clientBackend) Mutate(ctx context.Context, muts ...*Mutation) ([]*datastore.Key, error) {
+	dmuts, err := datastoreMutations(muts)
+	if err != nil {
+		return nil, err
+	}
+	return b.client.Mutate(ctx, dmuts...)
+}
+
+func (b *clientBackend) RunInTransaction(ctx context.Context, f func(tx Tx) error, opts ...datastore.TransactionOption) (Commit, error) {
+	cmt, err := b.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		return f(NewClientTx(ctx, b.client, tx))
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewClientCommit(cmt), nil
+}
+
+func (b *clientBackend) GetAll(ctx context.Context, q *QuerySpec, dst interface{}) ([]*datastore.Key, error) {
+	return b.client.GetAll(ctx, q.datastoreQuery(), dst)
+}
+
+func (b *clientBackend) Run(ctx context.Context, q *QuerySpec, dst interface{}) ([]*datastore.Key, datastore.Cursor, error) {
+	var slice reflect.Value
+	if dst != nil {
+		slice = reflect.ValueOf(dst)
+		if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+			return nil, datastore.Cursor{}, datastore.ErrInvalidEntityType
+		}
+		slice = slice.Elem()
+	}
+
+	var keys []*datastore.Key
+	var mismatchErr error
+	it := b.client.Run(ctx, q.datastoreQuery())
+	for {
+		var elem reflect.Value
+		var key *datastore.Key
+		var err error
+		if dst == nil {
+			key, err = it.Next(nil)
+		} else {
+			elem = newSliceElem(slice.Type().Elem())
+			key, err = it.Next(elem.Interface())
+		}
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+				return nil, datastore.Cursor{}, err
+			}
+			if mismatchErr == nil {
+				mismatchErr = err
+			}
+		}
+		keys = append(keys, key)
+		if dst != nil {
+			slice.Set(reflect.Append(slice, derefSliceElem(elem, slice.Type().Elem())))
+		}
+	}
+	c, err := it.Cursor()
+	if err != nil {
+		return nil, datastore.Cursor{}, err
+	}
+	return keys, c, mismatchErr
+}
+
+func (b *clientBackend) Count(ctx context.Context, q *QuerySpec) (int, error) {
+	return b.client.Count(ctx, q.datastoreQuery())
+}
+
+func (b *clientBackend) AllocateIDs(ctx context.Context, keys []*datastore.Key) ([]*datastore.Key, error) {
+	return b.client.AllocateIDs(ctx, keys)
+}
+
+func (b *clientBackend) Close() error {
+	return b.client.Close()
+}
+
+// NewClientTx wraps a transaction opened with client, e.g. by
+// datastore.Client.NewTransaction, into a Tx that can be passed to the *Tx
+// methods of a DSEnt. ctx is the context of the transaction, used by its
+// queries and returned by Context.
+//
+// The transaction is committed or rolled back by the caller. Pending keys
+// are resolved with the Commit returned by NewClientCommit.
+func NewClientTx(ctx context.Context, client *datastore.Client, tx *datastore.Transaction) Tx {
+	return &clientTx{ctx: ctx, client: client, tx: tx}
+}
+
+// NewClientCommit wraps the commit of a transaction wrapped by NewClientTx.
+func NewClientCommit(cmt *datastore.Commit) Commit {
+	return clientCommit{cmt}
+}
+
+// clientTx is the Tx of a clientBackend.
+type clientTx struct {
+	ctx    context.Context
+	client *datastore.Client
+	tx     *datastore.Transaction
+}
+
+func (t *clientTx) Context() context.Context {
+	return t.ctx
+}
+
+func (t *clientTx) Get(key *datastore.Key, dst interface{}) error {
+	return t.tx.Get(key, dst)
+}
+
+func (t *clientTx) GetMulti(keys []*datastore.Key, dst interface{}) error {
+	return t.tx.GetMulti(keys, dst)
+}
+
+func (t *clientTx) Mutate(muts ...*Mutation) ([]*PendingKey, error) {
+	dmuts, err := datastoreMutations(muts)
+	if err != nil {
+		return nil, err
+	}
+	dpks, err := t.tx.Mutate(dmuts...)
+	if err != nil {
+		return nil, err
+	}
+	pks := make([]*PendingKey, len(dpks))
+	for i, dpk := range dpks {
+		pks[i] = NewPendingKey(dpk)
+	}
+	return pks, nil
+}
+
+func (t *clientTx) GetAll(q *QuerySpec, dst interface{}) ([]*datastore.Key, error) {
+	return t.client.GetAll(t.ctx, q.datastoreQuery().Transaction(t.tx), dst)
+}
+
+// clientCommit is the Commit of a clientBackend transaction.
+type clientCommit struct {
+	cmt *datastore.Commit
+}
+
+func (c clientCommit) Key(pk *PendingKey) *datastore.Key {
+	if dpk, ok := pk.Ref().(*datastore.PendingKey); ok {
+		return c.cmt.Key(dpk)
+	}
+	return nil
+}
+
+// newSliceElem allocates a value to load an element of a slice of type []elemType into.
+// The returned value is always a pointer.
+func newSliceElem(elemType reflect.Type) reflect.Value {
+	if elemType.Kind() == reflect.Ptr {
+		return reflect.New(elemType.Elem())
+	}
+	return reflect.New(elemType)
+}
+
+// derefSliceElem converts a value allocated by newSliceElem into an element of a slice of type []elemType.
+func derefSliceElem(v reflect.Value, elemType reflect.Type) reflect.Value {
+	if elemType.Kind() == reflect.Ptr {
+		return v
+	}
+	return v.Elem()
+}
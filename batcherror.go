@@ -0,0 +1,151 @@
+package dsent
+
+import (
+	"errors"
+	"fmt"
+
+	"cloud.google.com/go/datastore"
+)
+
+// ItemError is the error of a single object of a batch operation.
+type ItemError[T Object] struct {
+	// Index is the index of the object in the input slice.
+	Index int
+	Obj   T
+	// Key is the key built for the object.
+	Key *datastore.Key
+	Err error
+}
+
+func (e *ItemError[T]) Error() string {
+	return fmt.Sprintf("%v: %v", e.Key, e.Err)
+}
+
+func (e *ItemError[T]) Unwrap() error {
+	return e.Err
+}
+
+// NotFound reports whether the entity of the object does not exist.
+func (e *ItemError[T]) NotFound() bool {
+	return errors.Is(e.Err, ErrNotFound)
+}
+
+// BatchError is returned by batch operations when some of the objects failed.
+// It holds the error of every object, in the order of the input slice.
+//
+// errors.Is(err, ErrNotFound) reports whether any entity was missing, and
+// errors.As with a *datastore.MultiError target gets the raw per-object errors.
+type BatchError[T Object] struct {
+	Objs []T
+	Keys []*datastore.Key
+	// Errs holds the error of every object, nil for those that succeeded.
+	Errs datastore.MultiError
+}
+
+// newBatchError maps the errors of a batch operation to its objects and keys.
+func newBatchError[T Object](objs []T, keys []*datastore.Key, errs datastore.MultiError) *BatchError[T] {
+	return &BatchError[T]{Objs: objs, Keys: keys, Errs: errs}
+}
+
+// batchError converts a datastore.MultiError with one entry per object into a
+// BatchError and returns other errors as is.
+func batchError[T Object](objs []T, keys []*datastore.Key, err error) error {
+	if merr, ok := err.(datastore.MultiError); ok && len(merr) == len(objs) {
+		return newBatchError(objs, keys, merr)
+	}
+	return err
+}
+
+func (e *BatchError[T]) Error() string {
+	items := e.Items()
+	switch len(items) {
+	case 0:
+		return fmt.Sprintf("batch of %d objects: no errors", len(e.Objs))
+	case 1:
+		return fmt.Sprintf("batch of %d objects: %v", len(e.Objs), items[0])
+	default:
+		return fmt.Sprintf("batch of %d objects: %v (and %d other errors)", len(e.Objs), items[0], len(items)-1)
+	}
+}
+
+// Unwrap returns the errors of the failed objects.
+func (e *BatchError[T]) Unwrap() []error {
+	var errs []error
+	for _, err := range e.Errs {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// As sets a *datastore.MultiError target to the per-object errors.
+func (e *BatchError[T]) As(target interface{}) bool {
+	if merr, ok := target.(*datastore.MultiError); ok {
+		*merr = e.Errs
+		return true
+	}
+	return false
+}
+
+// Err returns the error of the i-th object.
+func (e *BatchError[T]) Err(i int) error {
+	return e.Errs[i]
+}
+
+// item returns the ItemError of the i-th object.
+func (e *BatchError[T]) item(i int) *ItemError[T] {
+	return &ItemError[T]{Index: i, Obj: e.Objs[i], Key: e.Keys[i], Err: e.Errs[i]}
+}
+
+// Items returns the errors of all failed objects.
+func (e *BatchError[T]) Items() []*ItemError[T] {
+	var items []*ItemError[T]
+	for i, err := range e.Errs {
+		if err != nil {
+			items = append(items, e.item(i))
+		}
+	}
+	return items
+}
+
+// Failures returns the errors of the failed objects whose entity exists,
+// i.e. the failures other than ErrNotFound.
+func (e *BatchError[T]) Failures() []*ItemError[T] {
+	var items []*ItemError[T]
+	for i, err := range e.Errs {
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			items = append(items, e.item(i))
+		}
+	}
+	return items
+}
+
+// Found returns the objects that were processed, in input order. For reads,
+// objects loaded with an ErrFieldMismatch error are included.
+func (e *BatchError[T]) Found() []T {
+	var objs []T
+	for i, err := range e.Errs {
+		var mismatch *datastore.ErrFieldMismatch
+		if err == nil || errors.As(err, &mismatch) {
+			objs = append(objs, e.Objs[i])
+		}
+	}
+	return objs
+}
+
+// Missing returns the objects whose entity does not exist, in input order.
+func (e *BatchError[T]) Missing() []T {
+	var objs []T
+	for i, err := range e.Errs {
+		if errors.Is(err, ErrNotFound) {
+			objs = append(objs, e.Objs[i])
+		}
+	}
+	return objs
+}
+
+// OnlyMissing reports whether ErrNotFound is the only error of the batch.
+func (e *BatchError[T]) OnlyMissing() bool {
+	return len(e.Failures()) == 0
+}
@@ -0,0 +1,67 @@
+package dsent
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchError(t *testing.T) {
+	ctx := context.Background()
+	db := NewDSEntWithBackend[*memoryObj](NewMemoryBackend(), "", "Memory", WithRegistry(NewRegistry()))
+	_, _, err := db.BatchCreate(ctx, []*memoryObj{{ID: 1, Name: "a"}, {ID: 3, Name: "c"}})
+	require.NoError(t, err)
+
+	objs, err := db.BatchGet(ctx, []*memoryObj{{ID: 1}, {ID: 2}, {ID: 3}, {ID: 4}})
+	var berr *BatchError[*memoryObj]
+	require.ErrorAs(t, err, &berr)
+	require.ErrorIs(t, err, ErrNotFound)
+	require.True(t, berr.OnlyMissing())
+	require.Empty(t, berr.Failures())
+	require.Equal(t, []*memoryObj{objs[0], objs[2]}, berr.Found())
+	require.Equal(t, []*memoryObj{objs[1], objs[3]}, berr.Missing())
+	require.Equal(t, "c", berr.Found()[1].Name)
+
+	items := berr.Items()
+	require.Len(t, items, 2)
+	require.Equal(t, 1, items[0].Index)
+	require.Equal(t, int64(2), items[0].Key.ID)
+	require.Same(t, objs[1], items[0].Obj)
+	require.True(t, items[0].NotFound())
+	require.ErrorIs(t, items[1], ErrNotFound)
+	require.Contains(t, err.Error(), "batch of 4 objects")
+	require.Contains(t, err.Error(), "(and 1 other errors)")
+
+	var merr datastore.MultiError
+	require.ErrorAs(t, err, &merr)
+	require.Len(t, merr, 4)
+	require.NoError(t, merr[0])
+
+	// GetTx unwraps the error of its single object
+	_, err = db.RunInTransaction(ctx, func(tx Tx) error {
+		_, err := db.GetTx(tx, &memoryObj{ID: 2})
+		return err
+	})
+	require.Equal(t, ErrNotFound, err)
+}
+
+func TestBatchErrorFailures(t *testing.T) {
+	failure := errors.New("failure")
+	mismatch := &datastore.ErrFieldMismatch{FieldName: "x"}
+	objs := []*memoryObj{{ID: 1}, {ID: 2}, {ID: 3}}
+	keys := []*datastore.Key{datastore.IDKey("Memory", 1, nil), datastore.IDKey("Memory", 2, nil), datastore.IDKey("Memory", 3, nil)}
+	berr := newBatchError(objs, keys, datastore.MultiError{failure, ErrNotFound, mismatch})
+
+	require.False(t, berr.OnlyMissing())
+	require.ErrorIs(t, berr, failure)
+	failures := berr.Failures()
+	require.Len(t, failures, 2)
+	require.Equal(t, 0, failures[0].Index)
+	require.Equal(t, 2, failures[1].Index)
+	// entities loaded with a field mismatch are found
+	require.Equal(t, []*memoryObj{objs[2]}, berr.Found())
+	require.Equal(t, []*memoryObj{objs[1]}, berr.Missing())
+}
@@ -0,0 +1,245 @@
+package dsent
+
+import (
+	"context"
+	"sync"
+
+	"cloud.google.com/go/datastore"
+)
+
+const (
+	// MaxMutations is the maximum number of entities Datastore writes in a single call or transaction.
+	MaxMutations = 500
+	// MaxLookupKeys is the maximum number of keys Datastore looks up in a single call.
+	MaxLookupKeys = 1000
+)
+
+// bulkOptions is the configuration of a Bulk* call.
+type bulkOptions struct {
+	chunkSize   int
+	parallelism int
+}
+
+// BulkOption configures a Bulk* call.
+type BulkOption func(*bulkOptions)
+
+// WithChunkSize sets the number of entities per call. It is capped at the
+// Datastore limit of the operation, MaxMutations or MaxLookupKeys.
+func WithChunkSize(n int) BulkOption {
+	return func(o *bulkOptions) {
+		o.chunkSize = n
+	}
+}
+
+// WithParallelism sets the number of chunks processed concurrently, 1 by default.
+func WithParallelism(n int) BulkOption {
+	return func(o *bulkOptions) {
+		o.parallelism = n
+	}
+}
+
+// newBulkOptions applies opts to the defaults of an operation limited to limit entities per call.
+func newBulkOptions(limit int, opts []BulkOption) bulkOptions {
+	o := bulkOptions{chunkSize: limit, parallelism: 1}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.chunkSize <= 0 || o.chunkSize > limit {
+		o.chunkSize = limit
+	}
+	if o.parallelism <= 0 {
+		o.parallelism = 1
+	}
+	return o
+}
+
+// runChunks splits n items into chunks and calls f with the bounds of each chunk,
+// running up to o.parallelism chunks concurrently.
+//
+// f returns nil, an error for the whole chunk, or a datastore.MultiError with
+// one entry per item of the chunk. The errors are merged into a MultiError with
+// one entry per item, in the original order, however many chunks there are.
+func runChunks(ctx context.Context, n int, o bulkOptions, f func(ctx context.Context, lo, hi int) error) error {
+	errs := make(datastore.MultiError, n)
+	sem := make(chan struct{}, o.parallelism)
+	var wg sync.WaitGroup
+	for lo := 0; lo < n; lo += o.chunkSize {
+		hi := lo + o.chunkSize
+		if hi > n {
+			hi = n
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(lo, hi int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			// every goroutine writes to its own range of errs
+			err := f(ctx, lo, hi)
+			if merr, ok := err.(datastore.MultiError); ok && len(merr) == hi-lo {
+				copy(errs[lo:hi], merr)
+			} else if err != nil {
+				for i := lo; i < hi; i++ {
+					errs[i] = err
+				}
+			}
+		}(lo, hi)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return errs
+		}
+	}
+	return nil
+}
+
+// bulkMutate applies a mutation per object in chunks of at most MaxMutations,
+// without a transaction, and resolves the keys of the written objects.
+// The hooks of the objects run as for the non-transactional writes.
+// If the DSEnt audits its writes, every chunk is written within its own
+// transaction together with its audit entities.
+func (db *DSEnt[T]) bulkMutate(ctx context.Context, op MutationOp, objs []T, opts []BulkOption) ([]*datastore.Key, []T, error) {
+	var err error
+	if op == OpDelete {
+		err = db.beforeDelete(ctx, objs...)
+	} else {
+		err = db.prepareWrite(ctx, op, objs)
+	}
+	if err != nil {
+		return nil, objs, err
+	}
+	keys, err := db.buildKeys(objs)
+	if err != nil {
+		return nil, objs, err
+	}
+	err = runChunks(ctx, len(objs), newBulkOptions(db.mutationLimit(), opts), func(ctx context.Context, lo, hi int) error {
+		written, err := db.mutateChunk(ctx, op, keys[lo:hi], objs[lo:hi])
+		if err != nil {
+			return err
+		}
+		if op == OpDelete {
+			return nil
+		}
+		merr := make(datastore.MultiError, hi-lo)
+		failed := false
+		for i, key := range written {
+			keys[lo+i] = key
+			merr[i] = db.ResolveKey(key, objs[lo+i])
+			if merr[i] == nil {
+				merr[i] = db.afterSave(ctx, objs[lo+i])
+			}
+			if merr[i] != nil {
+				failed = true
+			}
+		}
+		if failed {
+			return merr
+		}
+		return nil
+	})
+	return keys, objs, batchError(objs, keys, err)
+}
+
+// mutateChunk applies a mutation per object of a chunk and returns the written keys.
+func (db *DSEnt[T]) mutateChunk(ctx context.Context, op MutationOp, keys []*datastore.Key, objs []T) ([]*datastore.Key, error) {
+	if db.writesInTx(op) {
+		var pks []*PendingKey
+		cmt, err := db.runInTransaction(ctx, func(tx Tx) error {
+			if op == OpDelete {
+				return db.purgeTx(tx, keys)
+			}
+			var err error
+			pks, err = db.stageWrite(tx, op, objs)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		written := make([]*datastore.Key, len(pks))
+		for i, pk := range pks {
+			written[i] = cmt.Key(pk)
+		}
+		return written, nil
+	}
+	muts := make([]*Mutation, len(objs))
+	for i, obj := range objs {
+		muts[i] = &Mutation{Op: op, Key: keys[i]}
+		if op != OpDelete {
+			muts[i].Src = obj
+		}
+	}
+	written, err := db.backend.Mutate(ctx, muts...)
+	db.invalidate(keys...)
+	db.invalidate(written...)
+	return written, err
+}
+
+// BulkCreate creates any number of entities, in chunks of at most MaxMutations.
+//
+// Unlike BatchCreate, it does not use a transaction: chunks succeed or fail
+// independently. Keys and objects are returned in the order of objs. If some
+// objects fail, the error is a *BatchError[T] mapping every object to its error;
+// the objects of a chunk that failed as a whole all get the error of the chunk.
+func (db *DSEnt[T]) BulkCreate(ctx context.Context, objs []T, opts ...BulkOption) (_ []*datastore.Key, _ []T, err error) {
+	ctx, span := db.startSpan(ctx, "BulkCreate", len(objs))
+	defer endSpan(span, &err)
+	return db.bulkMutate(ctx, OpInsert, objs, opts)
+}
+
+// BulkPut saves any number of entities, in chunks of at most MaxMutations.
+// See BulkCreate for how chunks and errors are handled.
+func (db *DSEnt[T]) BulkPut(ctx context.Context, objs []T, opts ...BulkOption) (_ []*datastore.Key, _ []T, err error) {
+	ctx, span := db.startSpan(ctx, "BulkPut", len(objs))
+	defer endSpan(span, &err)
+	return db.bulkMutate(ctx, OpUpsert, objs, opts)
+}
+
+// BulkDelete deletes any number of entities, in chunks of at most MaxMutations.
+// See BulkCreate for how chunks and errors are handled.
+//
+// With WithSoftDelete, every chunk is soft deleted within its own transaction.
+func (db *DSEnt[T]) BulkDelete(ctx context.Context, objs []T, opts ...BulkOption) (err error) {
+	ctx, span := db.startSpan(ctx, "BulkDelete", len(objs))
+	defer endSpan(span, &err)
+	if !db.softDelete() {
+		_, _, err := db.bulkMutate(ctx, OpDelete, objs, opts)
+		return err
+	}
+	if err := db.beforeDelete(ctx, objs...); err != nil {
+		return err
+	}
+	keys, err := db.buildKeys(objs)
+	if err != nil {
+		return err
+	}
+	err = runChunks(ctx, len(objs), newBulkOptions(db.mutationLimit(), opts), func(ctx context.Context, lo, hi int) error {
+		_, err := db.runInTransaction(ctx, func(tx Tx) error {
+			return db.softDeleteTx(tx, keys[lo:hi], objs[lo:hi])
+		})
+		return err
+	})
+	return batchError(objs, keys, err)
+}
+
+// BulkGet retrieves any number of entities, in chunks of at most MaxLookupKeys.
+//
+// As with BatchGet, the error is a *BatchError[T] mapping every object to its
+// error if some entities could not be loaded.
+func (db *DSEnt[T]) BulkGet(ctx context.Context, objs []T, opts ...BulkOption) (_ []T, err error) {
+	ctx, span := db.startSpan(ctx, "BulkGet", len(objs))
+	defer endSpan(span, &err)
+	return db.bulkGet(ctx, objs, opts)
+}
+
+// bulkGet implements BulkGet.
+func (db *DSEnt[T]) bulkGet(ctx context.Context, objs []T, opts []BulkOption) ([]T, error) {
+	keys, err := db.buildKeys(objs)
+	if err != nil {
+		return objs, err
+	}
+	err = runChunks(ctx, len(objs), newBulkOptions(MaxLookupKeys, opts), func(ctx context.Context, lo, hi int) error {
+		return db.getMulti(ctx, keys[lo:hi], objs[lo:hi])
+	})
+	err = db.hideDeleted(objs, keys, batchError(objs, keys, err))
+	return objs, db.afterLoadBatch(ctx, objs, err)
+}
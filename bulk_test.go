@@ -0,0 +1,88 @@
+package dsent
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestBulk(t *testing.T) {
+	ctx := context.Background()
+	db := NewDSEntWithBackend[*memoryObj](NewMemoryBackend(), "", "Memory", WithRegistry(NewRegistry()))
+
+	objs := make([]*memoryObj, 1200)
+	for i := range objs {
+		objs[i] = &memoryObj{ID: int64(i + 1), Score: i}
+	}
+
+	// the transactional batch methods are bound to the limits
+	_, _, err := db.BatchPut(ctx, objs)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	keys, objs, err := db.BulkCreate(ctx, objs, WithParallelism(3))
+	require.NoError(t, err)
+	require.Len(t, keys, len(objs))
+	for i, key := range keys {
+		require.Equal(t, int64(i+1), key.ID)
+	}
+
+	gets := make([]*memoryObj, 2500)
+	for i := range gets {
+		gets[i] = &memoryObj{ID: int64(i + 1)}
+	}
+	gets, err = db.BatchGet(ctx, gets)
+	berr, ok := err.(*BatchError[*memoryObj])
+	require.True(t, ok)
+	require.Len(t, berr.Errs, len(gets))
+	for i, obj := range gets {
+		if i < len(objs) {
+			require.NoError(t, berr.Errs[i])
+			require.Equal(t, i, obj.Score)
+		} else {
+			require.ErrorIs(t, berr.Errs[i], ErrNotFound)
+		}
+	}
+
+	// chunks fail independently and errors are reported per item
+	_, _, err = db.BulkCreate(ctx, []*memoryObj{{ID: 2000}, {ID: 2001}, {ID: 1}, {ID: 2002}}, WithChunkSize(2))
+	berr, ok = err.(*BatchError[*memoryObj])
+	require.True(t, ok)
+	require.NoError(t, berr.Errs[0])
+	require.NoError(t, berr.Errs[1])
+	require.Equal(t, codes.AlreadyExists, status.Code(berr.Errs[2]))
+	require.Equal(t, codes.AlreadyExists, status.Code(berr.Errs[3]))
+
+	// and so are the errors of a single chunk
+	_, _, err = db.BulkCreate(ctx, []*memoryObj{{ID: 2003}, {ID: 1}})
+	berr, ok = err.(*BatchError[*memoryObj])
+	require.True(t, ok)
+	require.Len(t, berr.Errs, 2)
+	require.Equal(t, codes.AlreadyExists, status.Code(berr.Errs[0]))
+	require.Equal(t, codes.AlreadyExists, status.Code(berr.Errs[1]))
+
+	for _, obj := range objs {
+		obj.Score = -1
+	}
+	_, _, err = db.BulkPut(ctx, objs, WithChunkSize(100), WithParallelism(4))
+	require.NoError(t, err)
+	n, err := db.Query().Filter("score", "=", -1).Count(ctx)
+	require.NoError(t, err)
+	require.Equal(t, len(objs), n)
+
+	require.NoError(t, db.BulkDelete(ctx, append(objs, &memoryObj{ID: 2000}, &memoryObj{ID: 2001}), WithParallelism(2)))
+	n, err = db.Query().Count(ctx)
+	require.NoError(t, err)
+	require.Zero(t, n)
+}
+
+func TestBulkOptions(t *testing.T) {
+	o := newBulkOptions(MaxMutations, nil)
+	require.Equal(t, bulkOptions{chunkSize: MaxMutations, parallelism: 1}, o)
+	o = newBulkOptions(MaxMutations, []BulkOption{WithChunkSize(1000), WithParallelism(-1)})
+	require.Equal(t, bulkOptions{chunkSize: MaxMutations, parallelism: 1}, o)
+	o = newBulkOptions(MaxLookupKeys, []BulkOption{WithChunkSize(10), WithParallelism(8)})
+	require.Equal(t, bulkOptions{chunkSize: 10, parallelism: 8}, o)
+}
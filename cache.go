@@ -0,0 +1,337 @@
+package dsent
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Cache stores the properties of entities, by the string of their key, see WithCache.
+// Implementations must be safe for concurrent use, and may evict entries at any time.
+type Cache interface {
+	// Get returns the properties stored for key, if any.
+	Get(key string) ([]datastore.Property, bool)
+	// Set stores the properties of the entity of key.
+	Set(key string, props []datastore.Property)
+	// Delete removes the entries of keys.
+	Delete(keys ...string)
+}
+
+// CacheStats counts the lookups of the cache of a DSEnt.
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+	// NegativeHits is the number of lookups of entities known not to exist,
+	// see WithNegativeCache.
+	NegativeHits uint64
+}
+
+// cacheStats holds the counters of CacheStats.
+type cacheStats struct {
+	hits         atomic.Uint64
+	misses       atomic.Uint64
+	negativeHits atomic.Uint64
+}
+
+// LRUCache is an in-process Cache that holds a bounded number of entries,
+// evicting the least recently used ones, for a bounded time.
+type LRUCache struct {
+	size int
+	ttl  time.Duration
+	now  func() time.Time
+
+	mu      sync.Mutex
+	entries *list.List
+	index   map[string]*list.Element
+}
+
+// lruEntry is an entry of a LRUCache.
+type lruEntry struct {
+	key     string
+	props   []datastore.Property
+	expires time.Time
+}
+
+// NewLRUCache creates a LRUCache of at most size entries, that expire ttl after
+// they are set. A ttl of 0 keeps entries until they are evicted.
+func NewLRUCache(size int, ttl time.Duration) *LRUCache {
+	return &LRUCache{
+		size:    size,
+		ttl:     ttl,
+		now:     time.Now,
+		entries: list.New(),
+		index:   map[string]*list.Element{},
+	}
+}
+
+func (c *LRUCache) Get(key string) ([]datastore.Property, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.index[key]
+	if !ok {
+		return nil, false
+	}
+	e := elem.Value.(*lruEntry)
+	if !e.expires.IsZero() && !c.now().Before(e.expires) {
+		c.remove(elem)
+		return nil, false
+	}
+	c.entries.MoveToFront(elem)
+	return e.props, true
+}
+
+func (c *LRUCache) Set(key string, props []datastore.Property) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var expires time.Time
+	if c.ttl > 0 {
+		expires = c.now().Add(c.ttl)
+	}
+	if elem, ok := c.index[key]; ok {
+		e := elem.Value.(*lruEntry)
+		e.props = props
+		e.expires = expires
+		c.entries.MoveToFront(elem)
+		return
+	}
+	c.index[key] = c.entries.PushFront(&lruEntry{key: key, props: props, expires: expires})
+	for c.entries.Len() > c.size {
+		c.remove(c.entries.Back())
+	}
+}
+
+func (c *LRUCache) Delete(keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		if elem, ok := c.index[key]; ok {
+			c.remove(elem)
+		}
+	}
+}
+
+// Len returns the number of entries of the cache, expired ones included.
+func (c *LRUCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries.Len()
+}
+
+// remove removes an entry, c.mu must be held.
+func (c *LRUCache) remove(elem *list.Element) {
+	c.entries.Remove(elem)
+	delete(c.index, elem.Value.(*lruEntry).key)
+}
+
+// CacheStats returns the number of cache hits and misses of the lookups of the DSEnt.
+func (db *DSEnt[T]) CacheStats() CacheStats {
+	return CacheStats{
+		Hits:         db.stats.hits.Load(),
+		Misses:       db.stats.misses.Load(),
+		NegativeHits: db.stats.negativeHits.Load(),
+	}
+}
+
+// cached reports whether the DSEnt caches entities, or their absence.
+func (db *DSEnt[T]) cached() bool {
+	return db.opts.cache != nil || db.opts.negativeCache != nil
+}
+
+// readThrough reports whether the entities are read through lookup.
+func (db *DSEnt[T]) readThrough() bool {
+	return db.cached() || db.opts.coalesce
+}
+
+// get loads the entity of key into obj like Backend.Get, through lookup.
+func (db *DSEnt[T]) get(ctx context.Context, key *datastore.Key, obj T) error {
+	if !db.readThrough() {
+		return db.backend.Get(ctx, key, obj)
+	}
+	err := db.getMulti(ctx, []*datastore.Key{key}, []T{obj})
+	if merr, ok := err.(datastore.MultiError); ok {
+		return merr[0]
+	}
+	return err
+}
+
+// getMulti loads the entities of keys into objs like Backend.GetMulti, through lookup.
+func (db *DSEnt[T]) getMulti(ctx context.Context, keys []*datastore.Key, objs []T) error {
+	if !db.readThrough() {
+		return db.backend.GetMulti(ctx, keys, objs)
+	}
+	props, err := db.lookup(ctx, keys)
+	merr, _ := err.(datastore.MultiError)
+	if err != nil && merr == nil {
+		return err
+	}
+	errs := make(datastore.MultiError, len(keys))
+	failed := false
+	for i, key := range keys {
+		if merr != nil && merr[i] != nil {
+			errs[i] = merr[i]
+		} else {
+			errs[i] = db.loadProperties(key, props[i], objs[i])
+		}
+		if errs[i] != nil {
+			failed = true
+		}
+	}
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+// lookup returns copies of the properties of the entities of keys, from the
+// cache, or fetched from the backend for those that are not cached. Errors are
+// reported with a datastore.MultiError.
+func (db *DSEnt[T]) lookup(ctx context.Context, keys []*datastore.Key) ([]datastore.PropertyList, error) {
+	props := make([]datastore.PropertyList, len(keys))
+	var errs datastore.MultiError
+	var missed []*datastore.Key
+	var index []int
+	for i, key := range keys {
+		if db.knownMissing(key) {
+			if errs == nil {
+				errs = make(datastore.MultiError, len(keys))
+			}
+			errs[i] = datastore.ErrNoSuchEntity
+			continue
+		}
+		if db.opts.cache == nil {
+			missed = append(missed, key)
+			index = append(index, i)
+			continue
+		}
+		if ps, ok := db.opts.cache.Get(keyString(key)); ok {
+			db.stats.hits.Add(1)
+			props[i] = copyProperties(ps)
+			continue
+		}
+		db.stats.misses.Add(1)
+		missed = append(missed, key)
+		index = append(index, i)
+	}
+	if len(missed) == 0 {
+		if errs != nil {
+			return props, errs
+		}
+		return props, nil
+	}
+	fetched, err := db.fetch(ctx, missed)
+	merr, _ := err.(datastore.MultiError)
+	if err != nil && merr == nil {
+		return nil, err
+	}
+	for j, i := range index {
+		if merr != nil && merr[j] != nil {
+			if errs == nil {
+				errs = make(datastore.MultiError, len(keys))
+			}
+			errs[i] = merr[j]
+			if merr[j] == datastore.ErrNoSuchEntity {
+				db.rememberMissing(missed[j])
+			}
+			continue
+		}
+		if db.opts.cache != nil {
+			db.opts.cache.Set(keyString(missed[j]), copyProperties(fetched[j]))
+		}
+		props[i] = fetched[j]
+	}
+	if errs != nil {
+		return props, errs
+	}
+	return props, nil
+}
+
+// loadProperties loads the properties of the entity of key into obj and resolves its key.
+func (db *DSEnt[T]) loadProperties(key *datastore.Key, props datastore.PropertyList, obj T) error {
+	err := obj.Load(props)
+	if loaded(err) {
+		if kerr := db.ResolveKey(key, obj); kerr != nil {
+			return kerr
+		}
+	}
+	return err
+}
+
+// knownMissing reports whether the entity of key is in the negative cache.
+func (db *DSEnt[T]) knownMissing(key *datastore.Key) bool {
+	if db.opts.negativeCache == nil {
+		return false
+	}
+	if _, ok := db.opts.negativeCache.Get(keyString(key)); ok {
+		db.stats.negativeHits.Add(1)
+		return true
+	}
+	return false
+}
+
+// rememberMissing adds the entity of key to the negative cache.
+func (db *DSEnt[T]) rememberMissing(key *datastore.Key) {
+	if db.opts.negativeCache != nil {
+		db.opts.negativeCache.Set(keyString(key), nil)
+	}
+}
+
+// invalidate removes the entities of keys from the cache and the negative cache.
+func (db *DSEnt[T]) invalidate(keys ...*datastore.Key) {
+	if !db.cached() {
+		return
+	}
+	ks := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if key != nil && !key.Incomplete() {
+			ks = append(ks, keyString(key))
+		}
+	}
+	if len(ks) == 0 {
+		return
+	}
+	if db.opts.cache != nil {
+		db.opts.cache.Delete(ks...)
+	}
+	if db.opts.negativeCache != nil {
+		db.opts.negativeCache.Delete(ks...)
+	}
+}
+
+// invalidateTx removes the entities of keys from the caches once tx has
+// committed, or right away if tx is not a ManagedTx.
+func (db *DSEnt[T]) invalidateTx(tx Tx, keys ...*datastore.Key) {
+	if !db.cached() {
+		return
+	}
+	if mtx, ok := tx.(*ManagedTx); ok {
+		mtx.OnCommit(func(Commit) {
+			db.invalidate(keys...)
+		})
+		return
+	}
+	db.invalidate(keys...)
+}
+
+// invalidatePendingTx is like invalidateTx for written entities. The keys are
+// resolved from pks once tx has committed, so that the entities created with
+// incomplete keys are removed from the negative cache too.
+func (db *DSEnt[T]) invalidatePendingTx(tx Tx, keys []*datastore.Key, pks []*PendingKey) {
+	if !db.cached() {
+		return
+	}
+	if mtx, ok := tx.(*ManagedTx); ok {
+		mtx.OnCommit(func(cmt Commit) {
+			resolved := make([]*datastore.Key, len(pks))
+			for i, pk := range pks {
+				resolved[i] = cmt.Key(pk)
+			}
+			db.invalidate(resolved...)
+		})
+		return
+	}
+	db.invalidate(keys...)
+}
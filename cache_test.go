@@ -0,0 +1,239 @@
+package dsent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+var _ Cache = (*LRUCache)(nil)
+
+func TestLRUCache(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	c := NewLRUCache(2, time.Minute)
+	c.now = func() time.Time { return now }
+	props := func(name string) []datastore.Property {
+		return []datastore.Property{{Name: "name", Value: name}}
+	}
+
+	c.Set("a", props("a"))
+	c.Set("b", props("b"))
+	_, ok := c.Get("a")
+	require.True(t, ok)
+	// b is the least recently used
+	c.Set("c", props("c"))
+	require.Equal(t, 2, c.Len())
+	_, ok = c.Get("b")
+	require.False(t, ok)
+	ps, ok := c.Get("a")
+	require.True(t, ok)
+	require.Equal(t, props("a"), ps)
+
+	c.Delete("a", "x")
+	_, ok = c.Get("a")
+	require.False(t, ok)
+
+	now = now.Add(time.Minute)
+	_, ok = c.Get("c")
+	require.False(t, ok)
+	require.Zero(t, c.Len())
+}
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemoryBackend()
+	db := newDSEnt[*memoryObj](t, backend, "Memory", WithCache(NewLRUCache(100, time.Minute)))
+	_, _, err := db.BatchCreate(ctx, []*memoryObj{{ID: 1, Name: "a", Tags: []string{"x"}}, {ID: 2, Name: "b"}})
+	require.NoError(t, err)
+
+	obj, err := db.Get(ctx, &memoryObj{ID: 1})
+	require.NoError(t, err)
+	require.Equal(t, "a", obj.Name)
+	require.Equal(t, CacheStats{Misses: 1}, db.CacheStats())
+	// the cached entity does not share values with the returned objects
+	obj.Tags[0] = "y"
+	obj, err = db.Get(ctx, &memoryObj{ID: 1})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), obj.ID)
+	require.Equal(t, []string{"x"}, obj.Tags)
+	require.Equal(t, CacheStats{Hits: 1, Misses: 1}, db.CacheStats())
+
+	objs, err := db.BatchGet(ctx, []*memoryObj{{ID: 1}, {ID: 2}, {ID: 3}})
+	berr, ok := err.(*BatchError[*memoryObj])
+	require.True(t, ok)
+	require.ErrorIs(t, berr.Errs[2], ErrNotFound)
+	require.Equal(t, "b", objs[1].Name)
+	require.Equal(t, CacheStats{Hits: 2, Misses: 3}, db.CacheStats())
+
+	// writes through the DSEnt invalidate the cache
+	_, _, err = db.Put(ctx, &memoryObj{ID: 1, Name: "c"})
+	require.NoError(t, err)
+	obj, err = db.Get(ctx, &memoryObj{ID: 1})
+	require.NoError(t, err)
+	require.Equal(t, "c", obj.Name)
+	_, err = db.Update(ctx, &memoryObj{ID: 2}, func(obj *memoryObj) (*memoryObj, error) {
+		obj.Name = "d"
+		return obj, nil
+	}, nil)
+	require.NoError(t, err)
+	obj, err = db.Get(ctx, &memoryObj{ID: 2})
+	require.NoError(t, err)
+	require.Equal(t, "d", obj.Name)
+	require.NoError(t, db.Delete(ctx, &memoryObj{ID: 2}))
+	_, err = db.Get(ctx, &memoryObj{ID: 2})
+	require.ErrorIs(t, err, ErrNotFound)
+	_, _, err = db.BulkPut(ctx, []*memoryObj{{ID: 1, Name: "e"}})
+	require.NoError(t, err)
+	obj, err = db.Get(ctx, &memoryObj{ID: 1})
+	require.NoError(t, err)
+	require.Equal(t, "e", obj.Name)
+
+	// writes made behind the back of the DSEnt are not seen
+	_, err = backend.Mutate(ctx, NewUpsert(SetNS(datastore.IDKey("Memory", 1, nil), ""), &memoryObj{Name: "f"}))
+	require.NoError(t, err)
+	obj, err = db.Get(ctx, &memoryObj{ID: 1})
+	require.NoError(t, err)
+	require.Equal(t, "e", obj.Name)
+}
+
+func TestCacheTx(t *testing.T) {
+	ctx := context.Background()
+	db := newMemoryDSEnt[*memoryObj](t, "Memory", WithCache(NewLRUCache(100, time.Minute)))
+	_, _, err := db.Create(ctx, &memoryObj{ID: 1, Name: "a"})
+	require.NoError(t, err)
+	_, err = db.Get(ctx, &memoryObj{ID: 1})
+	require.NoError(t, err)
+
+	// the cache is invalidated once the transaction commits
+	_, err = db.RunInTransaction(ctx, func(tx Tx) error {
+		if _, _, err := db.PutTx(tx, &memoryObj{ID: 1, Name: "b"}); err != nil {
+			return err
+		}
+		obj, err := db.Get(ctx, &memoryObj{ID: 1})
+		require.NoError(t, err)
+		require.Equal(t, "a", obj.Name)
+		return nil
+	})
+	require.NoError(t, err)
+	obj, err := db.Get(ctx, &memoryObj{ID: 1})
+	require.NoError(t, err)
+	require.Equal(t, "b", obj.Name)
+
+	// and not if it fails
+	_, err = db.RunInTransaction(ctx, func(tx Tx) error {
+		if err := db.DeleteTx(tx, &memoryObj{ID: 1}); err != nil {
+			return err
+		}
+		return ErrUpdateAbort
+	})
+	require.ErrorIs(t, err, ErrUpdateAbort)
+	stats := db.CacheStats()
+	_, err = db.Get(ctx, &memoryObj{ID: 1})
+	require.NoError(t, err)
+	require.Equal(t, stats.Hits+1, db.CacheStats().Hits)
+}
+
+func TestCacheSoftDelete(t *testing.T) {
+	ctx := context.Background()
+	db := newMemoryDSEnt[*softObj](t, "Soft", WithSoftDelete("deleted_at"), WithCache(NewLRUCache(100, time.Minute)))
+	_, _, err := db.Create(ctx, &softObj{ID: 1, Name: "a"})
+	require.NoError(t, err)
+	_, err = db.Get(ctx, &softObj{ID: 1})
+	require.NoError(t, err)
+
+	require.NoError(t, db.Delete(ctx, &softObj{ID: 1}))
+	_, err = db.Get(ctx, &softObj{ID: 1})
+	require.ErrorIs(t, err, ErrNotFound)
+	ok, err := db.Exists(ctx, &softObj{ID: 1})
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	_, err = db.Restore(ctx, &softObj{ID: 1})
+	require.NoError(t, err)
+	obj, err := db.Get(ctx, &softObj{ID: 1})
+	require.NoError(t, err)
+	require.Equal(t, "a", obj.Name)
+}
+
+// countingBackend is a MemoryBackend counting the reads of entities.
+type countingBackend struct {
+	*MemoryBackend
+	reads int
+}
+
+func (b *countingBackend) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	b.reads++
+	return b.MemoryBackend.GetMulti(ctx, keys, dst)
+}
+
+func (b *countingBackend) GetAll(ctx context.Context, q *QuerySpec, dst interface{}) ([]*datastore.Key, error) {
+	b.reads++
+	return b.MemoryBackend.GetAll(ctx, q, dst)
+}
+
+func TestNegativeCache(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingBackend{MemoryBackend: NewMemoryBackend()}
+	negative := NewLRUCache(100, time.Minute)
+	db := newDSEnt[*memoryObj](t, backend, "Memory", WithNegativeCache(negative))
+
+	_, err := db.Get(ctx, &memoryObj{ID: 1})
+	require.ErrorIs(t, err, ErrNotFound)
+	require.Equal(t, 1, backend.reads)
+	// Get, BatchGet and Exists share the negative cache
+	_, err = db.Get(ctx, &memoryObj{ID: 1})
+	require.ErrorIs(t, err, ErrNotFound)
+	ok, err := db.Exists(ctx, &memoryObj{ID: 1})
+	require.NoError(t, err)
+	require.False(t, ok)
+	ok, err = db.Exists(ctx, &memoryObj{ID: 2})
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.Equal(t, 2, backend.reads)
+	_, err = db.BatchGet(ctx, []*memoryObj{{ID: 1}, {ID: 2}})
+	berr, isBatch := err.(*BatchError[*memoryObj])
+	require.True(t, isBatch)
+	require.True(t, berr.OnlyMissing())
+	require.Equal(t, 2, backend.reads)
+	require.Equal(t, CacheStats{NegativeHits: 4}, db.CacheStats())
+
+	// writes clear the negative cache
+	_, _, err = db.Create(ctx, &memoryObj{ID: 1, Name: "a"})
+	require.NoError(t, err)
+	obj, err := db.Get(ctx, &memoryObj{ID: 1})
+	require.NoError(t, err)
+	require.Equal(t, "a", obj.Name)
+	_, err = db.Update(ctx, &memoryObj{ID: 2}, func(obj *memoryObj) (*memoryObj, error) {
+		obj.Name = "b"
+		return obj, nil
+	}, func(obj *memoryObj) (*memoryObj, error) {
+		return obj, nil
+	})
+	require.NoError(t, err)
+	ok, err = db.Exists(ctx, &memoryObj{ID: 2})
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// and so do the writes of entities with incomplete keys, once their key is allocated
+	_, err = db.Get(ctx, &memoryObj{ID: 3})
+	require.ErrorIs(t, err, ErrNotFound)
+	_, objs, err := db.BatchCreate(ctx, []*memoryObj{{Name: "c"}})
+	require.NoError(t, err)
+	require.Equal(t, int64(3), objs[0].ID)
+	obj, err = db.Get(ctx, &memoryObj{ID: 3})
+	require.NoError(t, err)
+	require.Equal(t, "c", obj.Name)
+	require.Zero(t, negative.Len())
+
+	// entries expire
+	_, err = db.Get(ctx, &memoryObj{ID: 4})
+	require.ErrorIs(t, err, ErrNotFound)
+	negative.now = func() time.Time { return time.Now().Add(time.Minute) }
+	reads := backend.reads
+	_, err = db.Get(ctx, &memoryObj{ID: 4})
+	require.ErrorIs(t, err, ErrNotFound)
+	require.Equal(t, reads+1, backend.reads)
+}
@@ -5,13 +5,19 @@ import (
 	"crypto/cipher"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
 	"io"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
 )
 
 // EncryptMessage encrypts a message using AES-256 with a arbitrary key.
 // Use it to encrypt the cursor string.
+//
+// Deprecated: the message is not authenticated, use CursorCodec instead.
 func EncryptMessage(key string, message string) (string, error) {
 	bkey := md5.Sum([]byte(key))
 	byteMsg := []byte(message)
@@ -34,6 +40,8 @@ func EncryptMessage(key string, message string) (string, error) {
 
 // DecryptMessage decrypts a message using AES-256 with a arbitrary key.
 // Use it to decrypt the cursor string.
+//
+// Deprecated: the message is not authenticated, use CursorCodec instead.
 func DecryptMessage(key string, message string) (string, error) {
 	bkey := md5.Sum([]byte(key))
 	cipherText, err := base64.StdEncoding.DecodeString(message)
@@ -58,3 +66,140 @@ func DecryptMessage(key string, message string) (string, error) {
 
 	return string(cipherText), nil
 }
+
+// ErrCursorAuth is returned when a cursor token fails authentication,
+// i.e. it was tampered with or encrypted with another secret.
+var ErrCursorAuth = fmt.Errorf("%w: authentication failed", ErrInvalidCursor)
+
+// cursorTokenV1 is the version byte of AES-256-GCM cursor tokens.
+const cursorTokenV1 byte = 1
+
+// cursorKDFInfo is the HKDF info string used to derive the AES-256-GCM key.
+const cursorKDFInfo = "dsent cursor token v1"
+
+// TokenCodec encrypts and authenticates page tokens.
+// Both CursorCodec and Keyring implement it.
+type TokenCodec interface {
+	// Encode encrypts and authenticates msg into a token.
+	Encode(msg []byte) (string, error)
+	// Decode verifies and decrypts a token produced by Encode.
+	// legacy reports whether the message came from an unauthenticated EncryptMessage token.
+	Decode(token string) (msg []byte, legacy bool, err error)
+}
+
+// CodecOption configures a CursorCodec.
+type CodecOption func(*CursorCodec)
+
+// WithLegacyDecryption makes the codec also accept tokens produced by
+// EncryptMessage with the given key until the given time.
+// A zero time accepts legacy tokens forever.
+func WithLegacyDecryption(key string, until time.Time) CodecOption {
+	return func(c *CursorCodec) {
+		c.legacy = true
+		c.legacyKey = key
+		c.legacyUntil = until
+	}
+}
+
+// CursorCodec encrypts and authenticates cursor tokens with AES-256-GCM.
+// Tokens are URL-safe base64 strings of a version byte, a random nonce and the sealed message.
+type CursorCodec struct {
+	aead        cipher.AEAD
+	legacy      bool
+	legacyKey   string
+	legacyUntil time.Time
+	now         func() time.Time
+}
+
+// NewCursorCodec creates a CursorCodec whose key is derived from secret with HKDF-SHA256.
+func NewCursorCodec(secret string, opts ...CodecOption) *CursorCodec {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(secret), nil, []byte(cursorKDFInfo)), key); err != nil {
+		panic("dsent: could not derive cursor key: " + err.Error())
+	}
+	// a 32 bytes key is always valid for AES-256, and AES always has a 16 bytes block.
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic("dsent: could not create new cipher: " + err.Error())
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic("dsent: could not create GCM: " + err.Error())
+	}
+	c := &CursorCodec{aead: aead, now: time.Now}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Encode encrypts and authenticates msg into a token.
+func (c *CursorCodec) Encode(msg []byte) (string, error) {
+	buf, err := c.seal([]byte{cursorTokenV1}, msg)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// seal encrypts msg and appends a random nonce and the sealed message to header.
+// The header is authenticated as additional data.
+func (c *CursorCodec) seal(header, msg []byte) ([]byte, error) {
+	nonceSize := c.aead.NonceSize()
+	buf := make([]byte, len(header)+nonceSize, len(header)+nonceSize+len(msg)+c.aead.Overhead())
+	copy(buf, header)
+	nonce := buf[len(header):]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("could not encrypt: %v", err)
+	}
+	return c.aead.Seal(buf, nonce, msg, buf[:len(header)]), nil
+}
+
+// open verifies and decrypts the nonce and sealed message following header in buf.
+func (c *CursorCodec) open(header, buf []byte) ([]byte, error) {
+	nonceSize := c.aead.NonceSize()
+	if len(buf) < len(header)+nonceSize+c.aead.Overhead() {
+		return nil, fmt.Errorf("%w: token too short", ErrInvalidCursor)
+	}
+	nonce := buf[len(header) : len(header)+nonceSize]
+	msg, err := c.aead.Open(nil, nonce, buf[len(header)+nonceSize:], header)
+	if err != nil {
+		return nil, ErrCursorAuth
+	}
+	return msg, nil
+}
+
+// Decode verifies and decrypts a token produced by Encode.
+// It returns ErrCursorAuth if the token does not authenticate.
+//
+// If the codec accepts legacy tokens and token is not a valid versioned token,
+// Decode falls back to DecryptMessage and reports legacy as true. This includes
+// tokens that fail authentication, as a legacy token may also look like a
+// versioned one. Legacy messages are NOT authenticated, callers must verify
+// them on their own.
+func (c *CursorCodec) Decode(token string) (msg []byte, legacy bool, err error) {
+	msg, err = c.decode(token)
+	if err == nil || !c.legacy || (!c.legacyUntil.IsZero() && c.now().After(c.legacyUntil)) {
+		return msg, false, err
+	}
+	plain, lerr := DecryptMessage(c.legacyKey, token)
+	if lerr != nil {
+		return nil, false, err
+	}
+	return []byte(plain), true, nil
+}
+
+// decode verifies and decrypts a versioned token.
+func (c *CursorCodec) decode(token string) ([]byte, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	if len(buf) == 0 {
+		return nil, fmt.Errorf("%w: token too short", ErrInvalidCursor)
+	}
+	if buf[0] != cursorTokenV1 {
+		return nil, fmt.Errorf("%w: unknown token version %d", ErrInvalidCursor, buf[0])
+	}
+	return c.open(buf[:1], buf)
+}
@@ -1,8 +1,11 @@
 package dsent
 
 import (
+	"encoding/base64"
 	"testing"
+	"time"
 
+	"cloud.google.com/go/datastore"
 	"github.com/stretchr/testify/require"
 )
 
@@ -31,3 +34,194 @@ func TestEncryptDecrypt(t *testing.T) {
 		}
 	}
 }
+
+func TestPageCursor(t *testing.T) {
+	db := NewDSEnt[*exampleObj](nil, "ns", "Test", WithCursorKey("secret"))
+	c, err := datastore.DecodeCursor("Y3Vyc29y")
+	require.NoError(t, err)
+
+	q := db.Query().Filter("id", ">", int64(5)).Order("-id")
+	token, err := db.encodeCursor(q, c)
+	require.NoError(t, err)
+	decoded, err := db.decodeCursor(q.Limit(10), token)
+	require.NoError(t, err)
+	require.Equal(t, c.String(), decoded.String())
+
+	// tampered token
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	require.NoError(t, err)
+	raw[len(raw)-1] ^= 0x01
+	_, err = db.decodeCursor(q, base64.RawURLEncoding.EncodeToString(raw))
+	require.ErrorIs(t, err, ErrCursorAuth)
+
+	// garbage token
+	_, err = db.decodeCursor(q, "not a token")
+	require.ErrorIs(t, err, ErrInvalidCursor)
+
+	// token issued for another namespace
+	other := NewDSEnt[*exampleObj](nil, "other", "Test", WithCursorKey("secret"))
+	_, err = other.decodeCursor(other.Query().Filter("id", ">", int64(5)).Order("-id"), token)
+	require.ErrorIs(t, err, ErrInvalidCursor)
+	require.Equal(t, &CursorContextError{Field: "namespace"}, err)
+
+	// token issued with another key
+	foreign := NewDSEnt[*exampleObj](nil, "ns", "Test", WithCursorKey("another secret"))
+	_, err = foreign.decodeCursor(foreign.Query(), token)
+	require.ErrorIs(t, err, ErrCursorAuth)
+}
+
+func TestPageCursorContext(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	db := NewDSEnt[*exampleObj](nil, "ns", "Test", WithCursorKey("secret"), WithCursorTTL(time.Minute))
+	db.opts.now = func() time.Time { return now }
+	c, err := datastore.DecodeCursor("Y3Vyc29y")
+	require.NoError(t, err)
+
+	q := db.Query().Filter("id", ">", int64(5)).Order("-id")
+	token, err := db.encodeCursor(q, c)
+	require.NoError(t, err)
+
+	queries := map[string]*Query[*exampleObj]{
+		"other value":    db.Query().Filter("id", ">", int64(6)).Order("-id"),
+		"other type":     db.Query().Filter("id", ">", "5").Order("-id"),
+		"other operator": db.Query().Filter("id", ">=", int64(5)).Order("-id"),
+		"other order":    db.Query().Filter("id", ">", int64(5)).Order("id"),
+		"no filter":      db.Query().Order("-id"),
+		"ancestor":       q.Ancestor(datastore.IDKey("Parent", 1, nil)),
+	}
+	for name, other := range queries {
+		_, err = db.decodeCursor(other, token)
+		require.Equal(t, &CursorContextError{Field: "query"}, err, name)
+	}
+
+	// values are compared as Datastore stores them
+	five := 5
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	same := map[string][2]*Query[*exampleObj]{
+		"int type": {q, db.Query().Filter("id", ">", 5).Order("-id")},
+		"pointer":  {q, db.Query().Filter("id", ">", &five).Order("-id")},
+		"in":       {db.Query().Filter("id", "in", []int{1, 2}), db.Query().Filter("id", "in", []interface{}{int64(1), int32(2)})},
+		"time":     {db.Query().Filter("at", "=", at), db.Query().Filter("at", "=", at.In(time.FixedZone("X", 3600)))},
+	}
+	for name, queries := range same {
+		token, err := db.encodeCursor(queries[0], c)
+		require.NoError(t, err)
+		_, err = db.decodeCursor(queries[1], token)
+		require.NoError(t, err, name)
+	}
+	// and pointers are not compared by address
+	other := 5
+	require.Equal(t, db.Query().Filter("id", ">", &five).spec.fingerprint(), db.Query().Filter("id", ">", &other).spec.fingerprint())
+
+	otherKind := NewDSEnt[*exampleObj](nil, "ns", "Other", WithCursorKey("secret"))
+	_, err = otherKind.decodeCursor(otherKind.Query().Filter("id", ">", int64(5)).Order("-id"), token)
+	require.Equal(t, &CursorContextError{Field: "kind"}, err)
+
+	now = now.Add(59 * time.Second)
+	_, err = db.decodeCursor(q, token)
+	require.NoError(t, err)
+
+	now = now.Add(2 * time.Second)
+	_, err = db.decodeCursor(q, token)
+	require.Equal(t, &CursorContextError{Field: "expiry"}, err)
+	require.ErrorIs(t, err, ErrInvalidCursor)
+}
+
+func TestPageCursorLegacy(t *testing.T) {
+	db := NewDSEnt[*exampleObj](nil, "ns", "Test", WithCursorKey("secret"), WithLegacyCursors(time.Time{}))
+	payload := db.cursorScope() + "\nY3Vyc29y"
+	legacy, err := EncryptMessage("secret", payload+"\n"+db.cursorMAC(payload))
+	require.NoError(t, err)
+
+	c, err := db.decodeCursor(db.Query(), legacy)
+	require.NoError(t, err)
+	require.Equal(t, "Y3Vyc29y", c.String())
+
+	// legacy token without a valid MAC
+	forged, err := EncryptMessage("secret", payload+"\nforged")
+	require.NoError(t, err)
+	_, err = db.decodeCursor(db.Query(), forged)
+	require.ErrorIs(t, err, ErrCursorAuth)
+
+	// legacy tokens are rejected once the migration window is over
+	expired := NewDSEnt[*exampleObj](nil, "ns", "Test", WithCursorKey("secret"), WithLegacyCursors(time.Now().Add(-time.Hour)))
+	_, err = expired.decodeCursor(expired.Query(), legacy)
+	require.ErrorIs(t, err, ErrInvalidCursor)
+
+	// and when legacy tokens are not enabled at all
+	strict := NewDSEnt[*exampleObj](nil, "ns", "Test", WithCursorKey("secret"))
+	_, err = strict.decodeCursor(strict.Query(), legacy)
+	require.ErrorIs(t, err, ErrInvalidCursor)
+}
+
+func TestCursorCodec(t *testing.T) {
+	codec := NewCursorCodec("secret")
+	msgs := [][]byte{
+		{},
+		[]byte("test"),
+		[]byte("testtesttesttesttesttesttesttest"),
+	}
+	for _, msg := range msgs {
+		token, err := codec.Encode(msg)
+		require.NoError(t, err)
+
+		dec, legacy, err := codec.Decode(token)
+		require.NoError(t, err)
+		require.False(t, legacy)
+		require.Equal(t, string(msg), string(dec))
+
+		raw, err := base64.RawURLEncoding.DecodeString(token)
+		require.NoError(t, err)
+		require.Equal(t, cursorTokenV1, raw[0])
+
+		// every single bit flip must be detected
+		for i := range raw {
+			tampered := append([]byte(nil), raw...)
+			tampered[i] ^= 0x80
+			_, _, err := codec.Decode(base64.RawURLEncoding.EncodeToString(tampered))
+			require.ErrorIs(t, err, ErrInvalidCursor)
+		}
+		_, _, err = NewCursorCodec("another secret").Decode(token)
+		require.ErrorIs(t, err, ErrCursorAuth)
+	}
+
+	_, _, err := codec.Decode("")
+	require.ErrorIs(t, err, ErrInvalidCursor)
+
+	legacyCodec := NewCursorCodec("secret", WithLegacyDecryption("legacy", time.Time{}))
+	token, err := EncryptMessage("legacy", "test")
+	require.NoError(t, err)
+	dec, legacy, err := legacyCodec.Decode(token)
+	require.NoError(t, err)
+	require.True(t, legacy)
+	require.Equal(t, "test", string(dec))
+
+	// legacy tokens that look like versioned tokens are decoded as legacy tokens
+	lookalike := ""
+	for lookalike == "" {
+		token, err := EncryptMessage("legacy", "legacy message")
+		require.NoError(t, err)
+		if raw, err := base64.RawURLEncoding.DecodeString(token); err == nil && raw[0] == cursorTokenV1 {
+			lookalike = token
+		}
+	}
+	_, _, err = codec.Decode(lookalike)
+	require.ErrorIs(t, err, ErrCursorAuth)
+	dec, legacy, err = legacyCodec.Decode(lookalike)
+	require.NoError(t, err)
+	require.True(t, legacy)
+	require.Equal(t, "legacy message", string(dec))
+
+	// tampered versioned tokens that are not legacy tokens either keep their error
+	token, err = legacyCodec.Encode([]byte("xy"))
+	require.NoError(t, err)
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	require.NoError(t, err)
+	raw[len(raw)-1] ^= 0x01
+	tampered := base64.RawURLEncoding.EncodeToString(raw)
+	_, err = DecryptMessage("legacy", tampered)
+	require.Error(t, err)
+	_, legacy, err = legacyCodec.Decode(tampered)
+	require.ErrorIs(t, err, ErrCursorAuth)
+	require.False(t, legacy)
+}
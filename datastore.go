@@ -5,8 +5,13 @@ package dsent
 import (
 	"context"
 	"errors"
+	"fmt"
+	"reflect"
+	"time"
 
 	"cloud.google.com/go/datastore"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
 // ErrKeyChanged is returned when the key of an entity has changed during a transaction.
@@ -30,18 +35,76 @@ type Object interface {
 // DSEnt is a generic Datastore entity wrapper that provides methods for
 // performing common operations on entities.
 type DSEnt[T Object] struct {
-	*datastore.Client
+	backend   Backend
 	namespace string
 	kind      string
+	opts      options
+	stats     *cacheStats
+	flights   *flightGroup
+	tracer    trace.Tracer
 }
 
 // NewDSEnt creates a new instance of DSEnt with the given Datastore client and namespace.
-func NewDSEnt[T Object](client *datastore.Client, ns string, kind string) *DSEnt[T] {
-	return &DSEnt[T]{
-		Client:    client,
+//
+// The kind is registered in the DefaultRegistry, or the one set with WithRegistry,
+// if it is not yet. NewDSEnt panics if the registered metadata of the kind does
+// not allow T or ns, use TryNewDSEnt to get an error instead.
+func NewDSEnt[T Object](client *datastore.Client, ns string, kind string, opts ...Option) *DSEnt[T] {
+	return NewDSEntWithBackend[T](NewClientBackend(client), ns, kind, opts...)
+}
+
+// NewDSEntWithBackend is like NewDSEnt but runs against the given backend,
+// e.g. a MemoryBackend in tests.
+func NewDSEntWithBackend[T Object](backend Backend, ns string, kind string, opts ...Option) *DSEnt[T] {
+	db, err := TryNewDSEntWithBackend[T](backend, ns, kind, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return db
+}
+
+// TryNewDSEnt is like NewDSEnt but returns an error instead of panicking if the
+// registered metadata of the kind does not allow T or ns.
+func TryNewDSEnt[T Object](client *datastore.Client, ns string, kind string, opts ...Option) (*DSEnt[T], error) {
+	return TryNewDSEntWithBackend[T](NewClientBackend(client), ns, kind, opts...)
+}
+
+// TryNewDSEntWithBackend is like TryNewDSEnt but runs against the given backend.
+func TryNewDSEntWithBackend[T Object](backend Backend, ns string, kind string, opts ...Option) (*DSEnt[T], error) {
+	db := &DSEnt[T]{
+		backend:   backend,
 		namespace: ns,
 		kind:      kind,
+		opts: options{
+			now:      time.Now,
+			registry: DefaultRegistry,
+		},
+		stats:   &cacheStats{},
+		flights: &flightGroup{calls: map[string]*flightCall{}},
+	}
+	for _, opt := range opts {
+		opt(&db.opts)
+	}
+	typ := reflect.TypeOf((*T)(nil)).Elem()
+	if err := db.opts.registry.use(kind, typ, ns); err != nil {
+		return nil, err
+	}
+	if _, ok := reflect.Zero(typ).Interface().(SoftDeletable); db.softDelete() && !ok {
+		return nil, fmt.Errorf("soft delete: %v does not implement SoftDeletable", typ)
+	}
+	if db.opts.cursorCodec == nil && db.opts.cursorKey != "" {
+		var codecOpts []CodecOption
+		if db.opts.legacyCursors {
+			codecOpts = append(codecOpts, WithLegacyDecryption(db.opts.cursorKey, db.opts.legacyUntil))
+		}
+		db.opts.cursorCodec = NewCursorCodec(db.opts.cursorKey, codecOpts...)
+	}
+	tp := db.opts.tracerProvider
+	if tp == nil {
+		tp = noop.NewTracerProvider()
 	}
+	db.tracer = tp.Tracer(tracerName)
+	return db, nil
 }
 
 // SetNS is a helper sets the namespace of a Datastore key and its parent keys.
@@ -77,6 +140,12 @@ func (db *DSEnt[T]) cmpKey(a, b *datastore.Key) bool {
 	}
 }
 
+// newObject allocates a new T to load an entity into.
+func newObject[T Object]() T {
+	typ := reflect.TypeOf((*T)(nil)).Elem()
+	return derefSliceElem(newSliceElem(typ), typ).Interface().(T)
+}
+
 // buildKeys builds Datastore keys for a slice of objects.
 func (db *DSEnt[T]) buildKeys(objs []T) ([]*datastore.Key, error) {
 	keys := make([]*datastore.Key, len(objs))
@@ -101,30 +170,83 @@ func (db *DSEnt[T]) ResolveKey(key *datastore.Key, obj T) error {
 	return nil
 }
 
-// Create creates a new entity in Datastore.
-func (db *DSEnt[T]) Create(ctx context.Context, obj T) (*datastore.Key, T, error) {
+// Backend returns the backend the DSEnt runs against.
+func (db *DSEnt[T]) Backend() Backend {
+	return db.backend
+}
+
+// Client returns the Datastore client the DSEnt runs against,
+// or nil if it runs against another backend, see NewDSEntWithBackend.
+func (db *DSEnt[T]) Client() *datastore.Client {
+	if b, ok := db.backend.(*clientBackend); ok {
+		return b.client
+	}
+	return nil
+}
+
+// RunInTransaction runs f in a transaction of the backend, see datastore.Client.RunInTransaction.
+// Pass the Tx to the *Tx methods to perform operations within the transaction.
+//
+// The transaction is retried as set by WithTxOptions, and the Tx is a
+// *ManagedTx, see Transact.
+func (db *DSEnt[T]) RunInTransaction(ctx context.Context, f func(tx Tx) error, opts ...datastore.TransactionOption) (_ Commit, err error) {
+	ctx, span := db.startSpan(ctx, "RunInTransaction", -1)
+	defer endSpan(span, &err)
+	return db.transact(ctx, span, func(tx *ManagedTx) error {
+		return f(tx)
+	}, []TxOption{WithDatastoreTxOptions(opts...)})
+}
+
+// writesInTx reports whether the DSEnt writes its entities with op within a
+// transaction, to record their audit entities, read their stored version or
+// replace the soft-deleted entities they create.
+func (db *DSEnt[T]) writesInTx(op MutationOp) bool {
+	return db.audited() || db.versioned() || (op == OpInsert && db.softDelete())
+}
+
+// write writes obj with a single non-transactional mutation, or within a
+// transaction if the DSEnt writes its entities within transactions.
+func (db *DSEnt[T]) write(ctx context.Context, op MutationOp, obj T) (*datastore.Key, T, error) {
+	if db.writesInTx(op) {
+		keys, objs, err := db.batchWrite(ctx, op, []T{obj})
+		if len(keys) == 0 {
+			return nil, objs[0], err
+		}
+		return keys[0], objs[0], err
+	}
+	if err := db.prepareWrite(ctx, op, []T{obj}); err != nil {
+		return nil, obj, err
+	}
 	key, err := obj.BuildKey(db.namespace)
 	if err != nil {
 		return nil, obj, err
 	}
-	mut := datastore.NewInsert(key, obj)
-	keys, err := db.Client.Mutate(ctx, mut)
+	keys, err := db.backend.Mutate(ctx, &Mutation{Op: op, Key: key, Src: obj})
+	db.invalidate(key)
 	if err != nil {
 		return nil, obj, err
 	}
 	key = keys[0]
-	return key, obj, db.ResolveKey(key, obj)
+	db.invalidate(key)
+	if err := db.ResolveKey(key, obj); err != nil {
+		return key, obj, err
+	}
+	return key, obj, db.afterSave(ctx, obj)
 }
 
-// BatchCreate creates multiple entities in Datastore within a transaction.
-func (db *DSEnt[T]) BatchCreate(ctx context.Context, objs []T) ([]*datastore.Key, []T, error) {
-	var pks []*datastore.PendingKey
-	var err error
-	cmt, err := db.Client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
-		pks, objs, err = db.BatchCreateTx(tx, objs)
+// batchWrite writes objs within a transaction, then resolves their keys and
+// runs their AfterSave hook once it is committed. The objects are prepared once,
+// before the transaction, so that retries do not prepare them again.
+func (db *DSEnt[T]) batchWrite(ctx context.Context, op MutationOp, objs []T) ([]*datastore.Key, []T, error) {
+	if err := db.prepareWrite(ctx, op, objs); err != nil {
+		return nil, objs, err
+	}
+	var pks []*PendingKey
+	cmt, err := db.runInTransaction(ctx, func(tx Tx) error {
+		var err error
+		pks, err = db.stageWrite(tx, op, objs)
 		return err
 	})
-
 	if err != nil {
 		return nil, objs, err
 	}
@@ -138,65 +260,198 @@ func (db *DSEnt[T]) BatchCreate(ctx context.Context, objs []T) ([]*datastore.Key
 			loadKeyErr = err
 		}
 	}
-	return keys, objs, loadKeyErr
+	if loadKeyErr != nil {
+		return keys, objs, loadKeyErr
+	}
+	return keys, objs, db.afterSave(ctx, objs...)
 }
 
-// CreateTx creates a new entity in Datastore within a transaction.
-func (db *DSEnt[T]) CreateTx(tx *datastore.Transaction, obj T) (*datastore.PendingKey, T, error) {
-	pks, objs, err := db.BatchCreateTx(tx, []T{obj})
-	if err != nil {
-		return nil, obj, err
+// writeTx prepares and stages the write of objs in tx, without running their AfterSave hook.
+func (db *DSEnt[T]) writeTx(tx Tx, op MutationOp, objs []T) ([]*PendingKey, error) {
+	if err := db.prepareWrite(tx.Context(), op, objs); err != nil {
+		return nil, err
 	}
-	return pks[0], objs[0], nil
+	return db.stageWrite(tx, op, objs)
 }
 
-// BatchCreateTx creates multiple entities in Datastore within a transaction.
-func (db *DSEnt[T]) BatchCreateTx(tx *datastore.Transaction, objs []T) ([]*datastore.PendingKey, []T, error) {
+// prepareWrite runs beforeWrite on every object, then sets their timestamps
+// once they all passed, so that a rejected write leaves them unchanged.
+func (db *DSEnt[T]) prepareWrite(ctx context.Context, op MutationOp, objs []T) error {
+	for _, obj := range objs {
+		if err := db.beforeWrite(ctx, op, obj); err != nil {
+			return err
+		}
+	}
+	for _, obj := range objs {
+		db.setTimestamps(op, obj)
+	}
+	return nil
+}
+
+// stageWrite stages the write of prepared objects in tx, and their audit
+// entities, setting their version from the stored entities.
+func (db *DSEnt[T]) stageWrite(tx Tx, op MutationOp, objs []T) ([]*PendingKey, error) {
 	keys, err := db.buildKeys(objs)
 	if err != nil {
-		return nil, objs, err
+		return nil, err
 	}
-	muts := make([]*datastore.Mutation, len(objs))
+	if err := db.allocateTx(tx, keys); err != nil {
+		return nil, err
+	}
+	var before [][]datastore.Property
+	if op == OpInsert && db.softDelete() {
+		// the soft-deleted entities are replaced
+		if before, err = db.readTx(tx, keys); err != nil {
+			return nil, err
+		}
+		if err := db.setVersions(objs, before); err != nil {
+			return nil, err
+		}
+	} else if op != OpInsert {
+		if before, err = db.versionTx(tx, keys, objs); err != nil {
+			return nil, err
+		}
+	} else if err := db.setVersions(objs, nil); err != nil {
+		return nil, err
+	}
+	muts := make([]*Mutation, len(objs))
 	for i, obj := range objs {
-		muts[i] = datastore.NewInsert(keys[i], obj)
+		muts[i] = &Mutation{Op: op, Key: keys[i], Src: obj}
+		if op == OpInsert && before != nil && before[i] != nil && db.deletedProperties(before[i]) {
+			muts[i].Op = OpUpsert
+		}
 	}
 	pks, err := tx.Mutate(muts...)
 	if err != nil {
-		return nil, objs, err
+		return nil, err
+	}
+	db.invalidatePendingTx(tx, keys, pks)
+	return pks, db.auditTx(tx, op, keys, before, objs)
+}
+
+// saveTx stages the write of objs in tx and runs their AfterSave hook.
+func (db *DSEnt[T]) saveTx(tx Tx, op MutationOp, objs []T) ([]*PendingKey, error) {
+	pks, err := db.writeTx(tx, op, objs)
+	if err != nil {
+		return nil, err
+	}
+	return pks, db.afterSave(tx.Context(), objs...)
+}
+
+// Create creates a new entity in Datastore.
+func (db *DSEnt[T]) Create(ctx context.Context, obj T) (_ *datastore.Key, _ T, err error) {
+	ctx, span := db.startSpan(ctx, "Create", 1)
+	defer endSpan(span, &err)
+	return db.write(ctx, OpInsert, obj)
+}
+
+// BatchCreate creates multiple entities in Datastore within a transaction.
+func (db *DSEnt[T]) BatchCreate(ctx context.Context, objs []T) (_ []*datastore.Key, _ []T, err error) {
+	ctx, span := db.startSpan(ctx, "BatchCreate", len(objs))
+	defer endSpan(span, &err)
+	return db.batchWrite(ctx, OpInsert, objs)
+}
+
+// CreateTx creates a new entity in Datastore within a transaction.
+func (db *DSEnt[T]) CreateTx(tx Tx, obj T) (_ *PendingKey, _ T, err error) {
+	span := db.startSpanTx(tx, "CreateTx", 1)
+	defer endSpan(span, &err)
+	pks, err := db.saveTx(tx, OpInsert, []T{obj})
+	if err != nil {
+		return nil, obj, err
+	}
+	return pks[0], obj, nil
+}
+
+// BatchCreateTx creates multiple entities in Datastore within a transaction.
+func (db *DSEnt[T]) BatchCreateTx(tx Tx, objs []T) (_ []*PendingKey, _ []T, err error) {
+	span := db.startSpanTx(tx, "BatchCreateTx", len(objs))
+	defer endSpan(span, &err)
+	pks, err := db.saveTx(tx, OpInsert, objs)
+	return pks, objs, err
+}
+
+// existsSpec is a keys-only query matching only key.
+func (db *DSEnt[T]) existsSpec(key *datastore.Key) *QuerySpec {
+	return &QuerySpec{
+		Kind:      key.Kind,
+		Namespace: db.namespace,
+		Filters:   []Filter{{Field: "__key__", Op: "=", Value: key}},
+		Limit:     1,
+		KeysOnly:  true,
 	}
-	return pks, objs, nil
 }
 
 // Exists checks if an entity exists in Datastore.
-func (db *DSEnt[T]) Exists(ctx context.Context, obj T) (bool, error) {
+func (db *DSEnt[T]) Exists(ctx context.Context, obj T) (_ bool, err error) {
+	ctx, span := db.startSpan(ctx, "Exists", 1)
+	defer endSpan(span, &err)
 	key, err := obj.BuildKey(db.namespace)
 	if err != nil {
 		return false, err
 	}
-	q := datastore.NewQuery(key.Kind).Namespace(db.namespace).FilterField("__key__", "=", key).KeysOnly().Limit(1)
-	keys, err := db.Client.GetAll(ctx, q, nil)
+	if db.softDelete() {
+		// the entity is loaded to tell whether it is soft deleted
+		stored := newObject[T]()
+		err := db.get(ctx, key, stored)
+		if loaded(err) && db.deleted(stored) {
+			return false, nil
+		}
+		return db.found(err)
+	}
+	if db.knownMissing(key) {
+		return false, nil
+	}
+	keys, err := db.backend.GetAll(ctx, db.existsSpec(key), nil)
 	if err != nil {
 		return false, err
 	}
+	if len(keys) == 0 {
+		db.rememberMissing(key)
+	}
 	return len(keys) > 0, nil
 }
 
 // ExistsTx checks if an entity exists in Datastore within a transaction.
-func (db *DSEnt[T]) ExistsTx(ctx context.Context, tx *datastore.Transaction, obj T) (bool, error) {
+//
+// The query runs with the context of tx, see Tx.Context, like the other Tx
+// methods: ctx is only checked before the query, which is not run if ctx is
+// done. The deadline and values of ctx are not used.
+func (db *DSEnt[T]) ExistsTx(ctx context.Context, tx Tx, obj T) (_ bool, err error) {
+	span := db.startSpanTx(tx, "ExistsTx", 1)
+	defer endSpan(span, &err)
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
 	key, err := obj.BuildKey(db.namespace)
 	if err != nil {
 		return false, err
 	}
-	q := datastore.NewQuery(key.Kind).Namespace(db.namespace).FilterField("__key__", "=", key).KeysOnly().Limit(1).Transaction(tx)
-	keys, err := db.Client.GetAll(ctx, q, nil)
+	if db.softDelete() {
+		_, err := db.loadTx(tx, key, newObject[T]())
+		return db.found(err)
+	}
+	keys, err := tx.GetAll(db.existsSpec(key), nil)
 	if err != nil {
 		return false, err
 	}
 	return len(keys) > 0, nil
 }
 
+// found converts the error of loading an entity to whether it exists.
+func (db *DSEnt[T]) found(err error) (bool, error) {
+	if err == datastore.ErrNoSuchEntity {
+		return false, nil
+	} else if !loaded(err) {
+		return false, err
+	}
+	return true, nil
+}
+
 // Get retrieves an entity from Datastore and populates the input object with the retrieved data.
-func (db *DSEnt[T]) Get(ctx context.Context, obj T) (T, error) {
+func (db *DSEnt[T]) Get(ctx context.Context, obj T) (_ T, err error) {
+	ctx, span := db.startSpan(ctx, "Get", 1)
+	defer endSpan(span, &err)
 	key, err := obj.BuildKey(db.namespace)
 	if err != nil {
 		if merr, ok := err.(datastore.MultiError); ok {
@@ -204,110 +459,143 @@ func (db *DSEnt[T]) Get(ctx context.Context, obj T) (T, error) {
 		}
 		return obj, err
 	}
-	err = db.Client.Get(ctx, key, obj)
+	err = db.get(ctx, key, obj)
+	if loaded(err) && db.deleted(obj) {
+		return obj, ErrNotFound
+	}
+	if loaded(err) {
+		if herr := db.afterLoad(ctx, obj); herr != nil {
+			return obj, herr
+		}
+	}
 	return obj, err
 }
 
 // GetTx retrieves an entity from Datastore within a transaction and populates the input object with the retrieved data.
-func (db *DSEnt[T]) GetTx(tx *datastore.Transaction, obj T) (T, error) {
-	objs, err := db.BatchGetTx(tx, []T{obj})
+func (db *DSEnt[T]) GetTx(tx Tx, obj T) (_ T, err error) {
+	span := db.startSpanTx(tx, "GetTx", 1)
+	defer endSpan(span, &err)
+	objs, err := db.getMultiTx(tx, []T{obj})
 	if err != nil {
-		if merr, ok := err.(datastore.MultiError); ok {
-			err = merr[0]
+		if berr, ok := err.(*BatchError[T]); ok {
+			err = berr.Err(0)
 		}
 		return obj, err
 	}
 	return objs[0], nil
 }
 
-// BatchGet retrieves multiple entities from Datastore.
-func (db *DSEnt[T]) BatchGet(ctx context.Context, objs []T) ([]T, error) {
-	keys, err := db.buildKeys(objs)
-	if err != nil {
-		return objs, err
-	}
-	if err := db.Client.GetMulti(ctx, keys, objs); err != nil {
-		return objs, err
-	}
-	return objs, nil
+// BatchGet retrieves multiple entities from Datastore, in chunks of at most MaxLookupKeys.
+// If some entities could not be loaded, the error is a *BatchError[T].
+func (db *DSEnt[T]) BatchGet(ctx context.Context, objs []T) (_ []T, err error) {
+	ctx, span := db.startSpan(ctx, "BatchGet", len(objs))
+	defer endSpan(span, &err)
+	return db.bulkGet(ctx, objs, nil)
 }
 
 // BatchGetTx retrieves multiple entities from Datastore within a transaction.
-func (db *DSEnt[T]) BatchGetTx(tx *datastore.Transaction, objs []T) ([]T, error) {
+// If some entities could not be loaded, the error is a *BatchError[T].
+func (db *DSEnt[T]) BatchGetTx(tx Tx, objs []T) (_ []T, err error) {
+	span := db.startSpanTx(tx, "BatchGetTx", len(objs))
+	defer endSpan(span, &err)
+	return db.getMultiTx(tx, objs)
+}
+
+// getMultiTx implements BatchGetTx.
+func (db *DSEnt[T]) getMultiTx(tx Tx, objs []T) ([]T, error) {
 	keys, err := db.buildKeys(objs)
 	if err != nil {
 		return objs, err
 	}
-	if err := tx.GetMulti(keys, objs); err != nil {
-		return objs, err
-	}
-	return objs, nil
+	err = db.hideDeleted(objs, keys, batchError(objs, keys, tx.GetMulti(keys, objs)))
+	return objs, db.afterLoadBatch(tx.Context(), objs, err)
 }
 
-// Put saves an entity to Datastore.
-func (db *DSEnt[T]) Put(ctx context.Context, obj T) (*datastore.Key, T, error) {
-	key, err := obj.BuildKey(db.namespace)
-	if err != nil {
-		return nil, obj, err
-	}
-	key, err = db.Client.Put(ctx, key, obj)
-	if err != nil {
-		return nil, obj, err
-	}
-	return key, obj, db.ResolveKey(key, obj)
+// BatchGetFound retrieves multiple entities from Datastore and splits the objects
+// into those that were loaded, with their keys resolved, and those whose entity
+// does not exist. Missing entities are not an error; other failures are
+// reported with a *BatchError[T] and their objects are in neither slice.
+func (db *DSEnt[T]) BatchGetFound(ctx context.Context, objs []T) (found []T, missing []T, err error) {
+	ctx, span := db.startSpan(ctx, "BatchGetFound", len(objs))
+	defer endSpan(span, &err)
+	objs, err = db.bulkGet(ctx, objs, nil)
+	return db.splitFound(objs, err)
 }
 
-// BatchPut saves multiple entities to Datastore within a transaction.
-func (db *DSEnt[T]) BatchPut(ctx context.Context, objs []T) ([]*datastore.Key, []T, error) {
-	keys, err := db.buildKeys(objs)
-	if err != nil {
-		return nil, objs, err
-	}
-	var pks []*datastore.PendingKey
-	cmt, err := db.Client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
-		pks, objs, err = db.BatchPutTx(tx, objs)
-		return err
-	})
-	if err != nil {
-		return nil, objs, err
-	}
+// BatchGetFoundTx is like BatchGetFound but within a transaction.
+func (db *DSEnt[T]) BatchGetFoundTx(tx Tx, objs []T) (found []T, missing []T, err error) {
+	span := db.startSpanTx(tx, "BatchGetFoundTx", len(objs))
+	defer endSpan(span, &err)
+	objs, err = db.getMultiTx(tx, objs)
+	return db.splitFound(objs, err)
+}
 
-	for i, pk := range pks {
-		keys[i] = cmt.Key(pk)
+// splitFound splits the objects of a batch get into found and missing ones.
+func (db *DSEnt[T]) splitFound(objs []T, err error) ([]T, []T, error) {
+	var errs datastore.MultiError
+	if berr, ok := err.(*BatchError[T]); ok {
+		errs = berr.Errs
+		if berr.OnlyMissing() {
+			err = nil
+		}
+	} else if err != nil {
+		return nil, nil, err
 	}
-	var loadKeyErr error
-	for i, key := range keys {
-		if err := db.ResolveKey(key, objs[i]); err != nil {
-			loadKeyErr = err
+	keys, kerr := db.buildKeys(objs)
+	if kerr != nil {
+		return nil, nil, kerr
+	}
+	found := make([]T, 0, len(objs))
+	var missing []T
+	for i, obj := range objs {
+		if errs != nil && errs[i] != nil {
+			var mismatch *datastore.ErrFieldMismatch
+			if errors.Is(errs[i], ErrNotFound) {
+				missing = append(missing, obj)
+				continue
+			} else if !errors.As(errs[i], &mismatch) {
+				continue
+			}
+		}
+		if rerr := db.ResolveKey(keys[i], obj); rerr != nil && err == nil {
+			err = rerr
 		}
+		found = append(found, obj)
 	}
-	return keys, objs, loadKeyErr
+	return found, missing, err
+}
+
+// Put saves an entity to Datastore.
+func (db *DSEnt[T]) Put(ctx context.Context, obj T) (_ *datastore.Key, _ T, err error) {
+	ctx, span := db.startSpan(ctx, "Put", 1)
+	defer endSpan(span, &err)
+	return db.write(ctx, OpUpsert, obj)
+}
+
+// BatchPut saves multiple entities to Datastore within a transaction.
+func (db *DSEnt[T]) BatchPut(ctx context.Context, objs []T) (_ []*datastore.Key, _ []T, err error) {
+	ctx, span := db.startSpan(ctx, "BatchPut", len(objs))
+	defer endSpan(span, &err)
+	return db.batchWrite(ctx, OpUpsert, objs)
 }
 
 // PutTx saves a single entity to Datastore within a transaction.
-func (db *DSEnt[T]) PutTx(tx *datastore.Transaction, obj T) (*datastore.PendingKey, T, error) {
-	pks, objs, err := db.BatchPutTx(tx, []T{obj})
+func (db *DSEnt[T]) PutTx(tx Tx, obj T) (_ *PendingKey, _ T, err error) {
+	span := db.startSpanTx(tx, "PutTx", 1)
+	defer endSpan(span, &err)
+	pks, err := db.saveTx(tx, OpUpsert, []T{obj})
 	if err != nil {
 		return nil, obj, err
 	}
-	return pks[0], objs[0], nil
+	return pks[0], obj, nil
 }
 
 // BatchPutTx saves multiple entities to Datastore within a transaction.
-func (db *DSEnt[T]) BatchPutTx(tx *datastore.Transaction, objs []T) ([]*datastore.PendingKey, []T, error) {
-	keys, err := db.buildKeys(objs)
-	if err != nil {
-		return nil, objs, err
-	}
-	muts := make([]*datastore.Mutation, len(objs))
-	for i, obj := range objs {
-		muts[i] = datastore.NewUpsert(keys[i], obj)
-	}
-	pks, err := tx.Mutate(muts...)
-	if err != nil {
-		return nil, objs, err
-	}
-	return pks, objs, nil
+func (db *DSEnt[T]) BatchPutTx(tx Tx, objs []T) (_ []*PendingKey, _ []T, err error) {
+	span := db.startSpanTx(tx, "BatchPutTx", len(objs))
+	defer endSpan(span, &err)
+	pks, err := db.saveTx(tx, OpUpsert, objs)
+	return pks, objs, err
 }
 
 // Update updates an entity in Datastore within a transaction.
@@ -315,115 +603,236 @@ func (db *DSEnt[T]) Update(
 	ctx context.Context, obj T,
 	updateFunc func(T) (T, error),
 	createFunc func(T) (T, error),
+) (_ T, err error) {
+	ctx, span := db.startSpan(ctx, "Update", 1)
+	defer endSpan(span, &err)
+	return db.update(ctx, obj, updateFunc, createFunc)
+}
+
+// update implements Update.
+func (db *DSEnt[T]) update(
+	ctx context.Context, obj T,
+	updateFunc func(T) (T, error),
+	createFunc func(T) (T, error),
 ) (T, error) {
 	var err error
-	_, err = db.Client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
-		obj, err = db.UpdateTx(tx, obj, updateFunc, createFunc)
+	var written bool
+	_, err = db.runInTransaction(ctx, func(tx Tx) error {
+		obj, written, err = db.updateTx(tx, obj, updateFunc, createFunc)
 		return err
 	})
 	if err != nil {
 		return obj, err
 	}
+	if written {
+		return obj, db.afterSave(ctx, obj)
+	}
 	return obj, nil
 }
 
 // UpdateTx updates an entity in Datastore within a transaction.
 func (db *DSEnt[T]) UpdateTx(
-	tx *datastore.Transaction, obj T,
+	tx Tx, obj T,
+	updateFunc func(T) (T, error),
+	createFunc func(T) (T, error),
+) (_ T, err error) {
+	span := db.startSpanTx(tx, "UpdateTx", 1)
+	defer endSpan(span, &err)
+	return db.updateSaveTx(tx, obj, updateFunc, createFunc)
+}
+
+// updateSaveTx implements UpdateTx.
+func (db *DSEnt[T]) updateSaveTx(
+	tx Tx, obj T,
 	updateFunc func(T) (T, error),
 	createFunc func(T) (T, error),
 ) (T, error) {
+	obj, written, err := db.updateTx(tx, obj, updateFunc, createFunc)
+	if err != nil || !written {
+		return obj, err
+	}
+	return obj, db.afterSave(tx.Context(), obj)
+}
+
+// updateTx implements UpdateTx without running the AfterSave hook,
+// and reports whether the entity was written.
+func (db *DSEnt[T]) updateTx(
+	tx Tx, obj T,
+	updateFunc func(T) (T, error),
+	createFunc func(T) (T, error),
+) (T, bool, error) {
+	ctx := tx.Context()
 	key, err := obj.BuildKey(db.namespace)
 	if err != nil {
-		return obj, err
+		return obj, false, err
 	}
 	created := false
-	if err := tx.Get(key, obj); err == datastore.ErrNoSuchEntity {
+	tombstone, err := db.loadTx(tx, key, obj)
+	if err == datastore.ErrNoSuchEntity {
 		if createFunc == nil {
-			return obj, err
+			return obj, false, err
 		}
 		obj, err = createFunc(obj)
 		if err != nil {
-			return obj, err
+			return obj, false, err
 		}
 		if newKey, err := obj.BuildKey(db.namespace); err == nil {
 			if !db.cmpKey(key, newKey) {
-				return obj, ErrKeyChanged
+				return obj, false, ErrKeyChanged
 			}
 		} else {
-			return obj, err
+			return obj, false, err
 		}
 		created = true
 	} else if err != nil {
-		return obj, err
+		return obj, false, err
+	} else if err := db.afterLoad(ctx, obj); err != nil {
+		return obj, false, err
 	}
 
 	if obj, err = updateFunc(obj); errors.Is(err, ErrUpdateAbort) {
-		return obj, nil
+		return obj, false, nil
 	} else if err != nil {
-		return obj, err
+		return obj, false, err
+	}
+
+	op := OpUpdate
+	if created {
+		op = OpInsert
+	}
+	if err := db.prepareWrite(ctx, op, []T{obj}); err != nil {
+		return obj, false, err
 	}
 	if newKey, err := obj.BuildKey(db.namespace); err == nil {
 		if !db.cmpKey(key, newKey) {
-			return obj, ErrKeyChanged
+			return obj, false, ErrKeyChanged
 		}
 	} else {
-		return obj, err
+		return obj, false, err
 	}
 
-	var mut *datastore.Mutation
-	if created {
-		mut = datastore.NewInsert(key, obj)
-	} else {
-		mut = datastore.NewUpdate(key, obj)
+	before, err := db.versionTx(tx, []*datastore.Key{key}, []T{obj})
+	if err != nil {
+		return obj, false, err
 	}
-	if _, err := tx.Mutate(mut); err != nil {
-		return obj, err
+	if tombstone {
+		// the created entity replaces the soft-deleted one
+		op = OpUpsert
 	}
-	return obj, nil
+	if _, err := tx.Mutate(&Mutation{Op: op, Key: key, Src: obj}); err != nil {
+		return obj, false, err
+	}
+	db.invalidateTx(tx, key)
+	if err := db.auditTx(tx, op, []*datastore.Key{key}, before, []T{obj}); err != nil {
+		return obj, false, err
+	}
+	return obj, true, nil
 }
 
-// Delete deletes an entity from Datastore.
-func (db *DSEnt[T]) Delete(ctx context.Context, obj T) error {
+// Delete deletes an entity from Datastore, or soft deletes it, see WithSoftDelete.
+func (db *DSEnt[T]) Delete(ctx context.Context, obj T) (err error) {
+	ctx, span := db.startSpan(ctx, "Delete", 1)
+	defer endSpan(span, &err)
+	if db.softDelete() || db.audited() {
+		return db.batchDelete(ctx, []T{obj})
+	}
+	if err := db.beforeDelete(ctx, obj); err != nil {
+		return err
+	}
 	key, err := obj.BuildKey(db.namespace)
 	if err != nil {
 		return err
 	}
-	return db.Client.Delete(ctx, key)
+	_, err = db.backend.Mutate(ctx, NewDelete(key))
+	db.invalidate(key)
+	return err
 }
 
 // DeleteTx deletes an entity from Datastore within a transaction.
-func (db *DSEnt[T]) DeleteTx(tx *datastore.Transaction, obj T) error {
-	return db.BatchDeleteTx(tx, []T{obj})
+func (db *DSEnt[T]) DeleteTx(tx Tx, obj T) (err error) {
+	span := db.startSpanTx(tx, "DeleteTx", 1)
+	defer endSpan(span, &err)
+	return db.deleteTx(tx, []T{obj})
 }
 
 // BatchDelete is transactional batch delete.
-func (db *DSEnt[T]) BatchDelete(ctx context.Context, objs []T) error {
-	if _, err := db.Client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
-		return db.BatchDeleteTx(tx, objs)
-	}); err != nil {
+func (db *DSEnt[T]) BatchDelete(ctx context.Context, objs []T) (err error) {
+	ctx, span := db.startSpan(ctx, "BatchDelete", len(objs))
+	defer endSpan(span, &err)
+	return db.batchDelete(ctx, objs)
+}
+
+// batchDelete implements BatchDelete.
+func (db *DSEnt[T]) batchDelete(ctx context.Context, objs []T) error {
+	if err := db.beforeDelete(ctx, objs...); err != nil {
 		return err
 	}
-	return nil
+	_, err := db.runInTransaction(ctx, func(tx Tx) error {
+		return db.stageDelete(tx, objs)
+	})
+	return err
 }
 
 // BatchDeleteTx is used to delete multiple entities in a transaction.
-func (db *DSEnt[T]) BatchDeleteTx(tx *datastore.Transaction, objs []T) error {
+func (db *DSEnt[T]) BatchDeleteTx(tx Tx, objs []T) (err error) {
+	span := db.startSpanTx(tx, "BatchDeleteTx", len(objs))
+	defer endSpan(span, &err)
+	return db.deleteTx(tx, objs)
+}
+
+// deleteTx implements BatchDeleteTx.
+func (db *DSEnt[T]) deleteTx(tx Tx, objs []T) error {
+	if err := db.beforeDelete(tx.Context(), objs...); err != nil {
+		return err
+	}
+	return db.stageDelete(tx, objs)
+}
+
+// stageDelete stages the deletion of objs in tx, without running their BeforeDelete hook.
+func (db *DSEnt[T]) stageDelete(tx Tx, objs []T) error {
 	keys, err := db.buildKeys(objs)
 	if err != nil {
 		return err
 	}
-	return tx.DeleteMulti(keys)
+	if db.softDelete() {
+		return db.softDeleteTx(tx, keys, objs)
+	}
+	return db.purgeTx(tx, keys)
+}
+
+// purgeTx stages the deletion of the entities of keys in tx, and their audit entities.
+func (db *DSEnt[T]) purgeTx(tx Tx, keys []*datastore.Key) error {
+	before, err := db.snapshotTx(tx, keys)
+	if err != nil {
+		return err
+	}
+	muts := make([]*Mutation, len(keys))
+	for i, key := range keys {
+		muts[i] = NewDelete(key)
+	}
+	if _, err := tx.Mutate(muts...); err != nil {
+		return err
+	}
+	db.invalidateTx(tx, keys...)
+	return db.auditTx(tx, OpDelete, keys, before, nil)
 }
 
 func (db *DSEnt[T]) Close() {
-	db.Client.Close()
+	db.backend.Close()
 }
 
 func (db *DSEnt[T]) Namespace() string {
 	return db.namespace
 }
 
+// NewQuery returns a raw Datastore query over the kind and namespace of the DSEnt.
+// Prefer Query, which also works with other backends than Datastore.
+// Soft-deleted entities are excluded, see WithSoftDelete.
 func (db *DSEnt[T]) NewQuery() *datastore.Query {
-	return datastore.NewQuery(db.kind).Namespace(db.namespace)
+	q := datastore.NewQuery(db.kind).Namespace(db.namespace)
+	if db.softDelete() {
+		f := db.notDeletedFilter()
+		q = q.FilterField(f.Field, f.Op, f.Value)
+	}
+	return q
 }
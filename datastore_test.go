@@ -115,11 +115,22 @@ type DSEntTestSuite struct {
 	dropMissing *DSEnt[*objDropMissingKey]
 	keepMissing *DSEnt[*objKeepMissingKey]
 
+	// newBackend creates the backend to run against, Datastore if it is nil.
+	newBackend func() Backend
+
 	ctx    context.Context
 	cancel func()
 }
 
 func (suite *DSEntTestSuite) SetupSuite() {
+	if suite.newBackend != nil {
+		backend := suite.newBackend()
+		suite.DSEnt = NewDSEntWithBackend[*exampleObj](backend, namespace, "Test", WithCursorKey("test"))
+		suite.dropMissing = NewDSEntWithBackend[*objDropMissingKey](backend, namespace, "Test")
+		suite.keepMissing = NewDSEntWithBackend[*objKeepMissingKey](backend, namespace, "Test")
+		return
+	}
+
 	projectId := os.Getenv("DATASTORE_PROJECT_ID")
 	emulatorHost := os.Getenv("DATASTORE_EMULATOR_HOST")
 	if projectId == "" {
@@ -133,7 +144,7 @@ func (suite *DSEntTestSuite) SetupSuite() {
 	client, err := datastore.NewClient(ctx, "")
 	suite.Require().NoError(err)
 
-	entity := NewDSEnt[*exampleObj](client, namespace, "Test")
+	entity := NewDSEnt[*exampleObj](client, namespace, "Test", WithCursorKey("test"))
 	suite.DSEnt = entity
 	suite.dropMissing = NewDSEnt[*objDropMissingKey](client, namespace, "Test")
 	suite.keepMissing = NewDSEnt[*objKeepMissingKey](client, namespace, "Test")
@@ -300,7 +311,7 @@ func (suite *DSEntTestSuite) Test07UpdateTx() {
 		objs = append(objs, obj)
 	}
 
-	_, err := suite.RunInTransaction(suite.ctx, func(tx *datastore.Transaction) error {
+	_, err := suite.RunInTransaction(suite.ctx, func(tx Tx) error {
 		for _, obj := range objs {
 			if _, err := suite.UpdateTx(tx, &exampleObj{ID: obj.ID},
 				func(eo *exampleObj) (*exampleObj, error) {
@@ -320,6 +331,101 @@ func (suite *DSEntTestSuite) Test07UpdateTx() {
 	suite.NoError(err)
 }
 
+func (suite *DSEntTestSuite) Test08Query() {
+	q := suite.Query().Filter("id", ">", int64(5)).Order("-id")
+
+	objs, err := q.All(suite.ctx)
+	suite.Require().NoError(err)
+	suite.Require().Len(objs, 5)
+	for i, obj := range objs {
+		suite.Assert().Equal(int64(10-i), obj.ID)
+		suite.Assert().Equal(obj.ID, obj.LoadedKey)
+	}
+
+	first, err := q.First(suite.ctx)
+	suite.Require().NoError(err)
+	suite.Assert().Equal(int64(10), first.ID)
+
+	keys, err := q.Limit(2).Keys(suite.ctx)
+	suite.Require().NoError(err)
+	suite.Require().Len(keys, 2)
+	suite.Assert().Equal(int64(10), keys[0].ID)
+	suite.Assert().Equal(int64(9), keys[1].ID)
+
+	n, err := q.Count(suite.ctx)
+	suite.Require().NoError(err)
+	suite.Assert().Equal(5, n)
+
+	_, err = suite.Query().Filter("id", ">", int64(100)).First(suite.ctx)
+	suite.Require().ErrorIs(err, ErrNotFound)
+}
+
+func (suite *DSEntTestSuite) Test09Page() {
+	q := suite.Query().Order("id")
+
+	var ids []int64
+	token := ""
+	for i := 0; ; i++ {
+		suite.Require().Less(i, 10, "too many pages")
+		objs, next, err := suite.Page(suite.ctx, q, 3, token)
+		suite.Require().NoError(err)
+		for _, obj := range objs {
+			suite.Assert().Equal(obj.ID, obj.LoadedKey)
+			ids = append(ids, obj.ID)
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	suite.Require().Equal([]int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, ids)
+
+	_, _, err := suite.Page(suite.ctx, q, 3, "tampered")
+	suite.Require().ErrorIs(err, ErrInvalidCursor)
+}
+
+func (suite *DSEntTestSuite) Test10BatchGetFound() {
+	objs := []*exampleObj{{ID: 3}, {ID: 42}, {ID: 1}, {ID: 43}}
+	found, missing, err := suite.BatchGetFound(suite.ctx, objs)
+	suite.Require().NoError(err)
+	suite.Require().Len(found, 2)
+	suite.Assert().Equal(int64(3), found[0].LoadedKey)
+	suite.Assert().Equal(int64(1), found[1].LoadedKey)
+	suite.Assert().Equal(found[0].ID+1, int64(found[0].Data))
+	suite.Require().Len(missing, 2)
+	suite.Assert().Equal(int64(42), missing[0].ID)
+	suite.Assert().Equal(int64(43), missing[1].ID)
+
+	_, err = suite.RunInTransaction(suite.ctx, func(tx Tx) error {
+		found, missing, err := suite.BatchGetFoundTx(tx, []*exampleObj{{ID: 44}, {ID: 2}})
+		suite.Require().NoError(err)
+		suite.Require().Len(found, 1)
+		suite.Assert().Equal(int64(2), found[0].LoadedKey)
+		suite.Require().Len(missing, 1)
+		return nil
+	})
+	suite.Require().NoError(err)
+}
+
+func (suite *DSEntTestSuite) Test11ClientTx() {
+	client := suite.Client()
+	if client == nil {
+		suite.T().Skip("the suite does not run against Datastore")
+	}
+	tx, err := client.NewTransaction(suite.ctx)
+	suite.Require().NoError(err)
+	pk, _, err := suite.PutTx(NewClientTx(suite.ctx, client, tx), &exampleObj{ID: 20, Data: 20})
+	suite.Require().NoError(err)
+	cmt, err := tx.Commit()
+	suite.Require().NoError(err)
+	suite.Require().Equal(int64(20), NewClientCommit(cmt).Key(pk).ID)
+
+	obj, err := suite.Get(suite.ctx, &exampleObj{ID: 20})
+	suite.Require().NoError(err)
+	suite.Require().Equal(20, obj.Data)
+	suite.Require().NoError(suite.Delete(suite.ctx, obj))
+}
+
 func (suite *DSEntTestSuite) Test97UpdateConflict() {
 	suite.BatchCreate(suite.ctx, []*exampleObj{
 		{ID: 1, Data: 1},
@@ -328,7 +434,7 @@ func (suite *DSEntTestSuite) Test97UpdateConflict() {
 	// tx1
 	var errA error
 	go func() {
-		_, errA = suite.RunInTransaction(suite.ctx, func(tx *datastore.Transaction) error {
+		_, errA = suite.RunInTransaction(suite.ctx, func(tx Tx) error {
 			if _, err := suite.UpdateTx(tx, &exampleObj{ID: 1},
 				func(eo *exampleObj) (*exampleObj, error) {
 					eo.Data += 1
@@ -346,7 +452,7 @@ func (suite *DSEntTestSuite) Test97UpdateConflict() {
 	// tx2
 	var errB error
 	go func() {
-		_, errB = suite.RunInTransaction(suite.ctx, func(tx *datastore.Transaction) error {
+		_, errB = suite.RunInTransaction(suite.ctx, func(tx Tx) error {
 			if _, err := suite.UpdateTx(tx, &exampleObj{ID: 1},
 				func(eo *exampleObj) (*exampleObj, error) {
 					eo.Data += 1
@@ -383,24 +489,24 @@ func (suite *DSEntTestSuite) Test99DropMismatch() {
 
 func (suite *DSEntTestSuite) purge(ctx context.Context) (int, error) {
 	sum := 0
-	q := datastore.NewQuery("").Namespace(namespace).KeysOnly().Limit(500)
+	q := &QuerySpec{Namespace: namespace, KeysOnly: true, Limit: 500}
 
 	for i := 0; ; i++ {
-		keys, err := suite.DSEnt.GetAll(ctx, q, nil)
+		keys, err := suite.backend.GetAll(ctx, q, nil)
 		if err != nil {
 			return sum, fmt.Errorf("failed to get keys: %w", err)
 		}
-		deleteKeys := make([]*datastore.Key, 0, len(keys))
+		muts := make([]*Mutation, 0, len(keys))
 		for _, k := range keys {
 			if !strings.HasPrefix(k.Kind, "__") {
-				deleteKeys = append(deleteKeys, k)
+				muts = append(muts, NewDelete(k))
 			}
 		}
-		if len(deleteKeys) == 0 {
+		if len(muts) == 0 {
 			break
 		}
-		sum += len(deleteKeys)
-		if err := suite.DSEnt.DeleteMulti(ctx, deleteKeys); err != nil {
+		sum += len(muts)
+		if _, err := suite.backend.Mutate(ctx, muts...); err != nil {
 			return sum, fmt.Errorf("failed to delete keys: %w", err)
 		}
 	}
@@ -425,3 +531,8 @@ func (suite *DSEntTestSuite) TearDownSuite() {
 func TestDSEnt(t *testing.T) {
 	suite.Run(t, new(DSEntTestSuite))
 }
+
+// TestDSEntMemory runs the suite against a MemoryBackend.
+func TestDSEntMemory(t *testing.T) {
+	suite.Run(t, &DSEntTestSuite{newBackend: func() Backend { return NewMemoryBackend() }})
+}
@@ -0,0 +1,285 @@
+// Package dsenttest provides helpers to test code built on dsent: an isolated
+// DSEnt per test, fixtures and assertions on the stored entities.
+//
+// Tests run against the Datastore emulator when DATASTORE_EMULATOR_HOST is set,
+// along with DATASTORE_PROJECT_ID, and against a dsent.MemoryBackend otherwise.
+package dsenttest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/assert"
+	"pkg.lucas.icu/dsent"
+)
+
+// purgeBatchSize is the number of entities deleted per call when purging a namespace.
+const purgeBatchSize = 500
+
+// maxNamespaceLen is the maximum length of a Datastore namespace.
+const maxNamespaceLen = 100
+
+// invalidNamespaceChars matches the characters not allowed in a Datastore namespace.
+var invalidNamespaceChars = regexp.MustCompile(`[^0-9A-Za-z._-]+`)
+
+// config is the configuration of an Env.
+type config struct {
+	backend   dsent.Backend
+	namespace string
+	opts      []dsent.Option
+}
+
+// Option configures an Env.
+type Option func(*config)
+
+// WithBackend runs the Env against the given backend instead of the emulator
+// or a new MemoryBackend. The backend is not closed on cleanup.
+func WithBackend(backend dsent.Backend) Option {
+	return func(c *config) {
+		c.backend = backend
+	}
+}
+
+// WithNamespace sets the namespace of the Env instead of a unique one derived
+// from the name of the test. The namespace is still purged on cleanup.
+func WithNamespace(ns string) Option {
+	return func(c *config) {
+		c.namespace = ns
+	}
+}
+
+// WithOptions passes options to dsent.TryNewDSEntWithBackend.
+// Unless one of them is dsent.WithRegistry, the kind is registered in a new registry.
+func WithOptions(opts ...dsent.Option) Option {
+	return func(c *config) {
+		c.opts = append(c.opts, opts...)
+	}
+}
+
+// Env is an isolated DSEnt for a single test.
+type Env[T dsent.Object] struct {
+	*dsent.DSEnt[T]
+	t testing.TB
+}
+
+// New creates an Env for the entities of the given kind in a unique namespace.
+// The namespace is purged, and the backend closed if New created it, when the test completes.
+func New[T dsent.Object](t testing.TB, kind string, opts ...Option) *Env[T] {
+	t.Helper()
+	c := &config{namespace: UniqueNamespace(t)}
+	for _, opt := range opts {
+		opt(c)
+	}
+	backend := c.backend
+	if backend == nil {
+		backend = NewBackend(t)
+	}
+	dsentOpts := append([]dsent.Option{dsent.WithRegistry(dsent.NewRegistry())}, c.opts...)
+	db, err := dsent.TryNewDSEntWithBackend[T](backend, c.namespace, kind, dsentOpts...)
+	if err != nil {
+		t.Fatalf("new DSEnt for kind %q: %v", kind, err)
+	}
+	env := &Env[T]{DSEnt: db, t: t}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if _, err := Purge(ctx, backend, c.namespace); err != nil {
+			t.Errorf("purge namespace %q: %v", c.namespace, err)
+		}
+	})
+	return env
+}
+
+// NewBackend returns a backend running against the Datastore emulator if
+// DATASTORE_EMULATOR_HOST is set, or a new MemoryBackend otherwise.
+// The backend is closed when the test completes.
+func NewBackend(t testing.TB) dsent.Backend {
+	t.Helper()
+	if os.Getenv("DATASTORE_EMULATOR_HOST") == "" {
+		return dsent.NewMemoryBackend()
+	}
+	if os.Getenv("DATASTORE_PROJECT_ID") == "" {
+		t.Skip("DATASTORE_EMULATOR_HOST is set but DATASTORE_PROJECT_ID is not, skipping test")
+	}
+	client, err := datastore.NewClient(context.Background(), "")
+	if err != nil {
+		t.Fatalf("create Datastore client: %v", err)
+	}
+	backend := dsent.NewClientBackend(client)
+	t.Cleanup(func() {
+		backend.Close()
+	})
+	return backend
+}
+
+// UniqueNamespace returns a valid namespace derived from the name of the test
+// with a random suffix, so parallel tests and repeated runs do not collide.
+func UniqueNamespace(t testing.TB) string {
+	suffix := fmt.Sprintf("-%08x", rand.Uint32())
+	name := strings.Trim(invalidNamespaceChars.ReplaceAllString(t.Name(), "-"), "-")
+	if max := maxNamespaceLen - len(suffix); len(name) > max {
+		name = name[:max]
+	}
+	return name + suffix
+}
+
+// Purge deletes all entities of a namespace and returns how many were deleted.
+// Kinds starting with "__", such as statistics, are left alone.
+func Purge(ctx context.Context, backend dsent.Backend, ns string) (int, error) {
+	sum := 0
+	q := &dsent.QuerySpec{Namespace: ns, KeysOnly: true, Limit: purgeBatchSize}
+	for {
+		keys, err := backend.GetAll(ctx, q, nil)
+		if err != nil {
+			return sum, fmt.Errorf("failed to get keys: %w", err)
+		}
+		muts := make([]*dsent.Mutation, 0, len(keys))
+		for _, k := range keys {
+			if !strings.HasPrefix(k.Kind, "__") {
+				muts = append(muts, dsent.NewDelete(k))
+			}
+		}
+		if len(muts) == 0 {
+			return sum, nil
+		}
+		if _, err := backend.Mutate(ctx, muts...); err != nil {
+			return sum, fmt.Errorf("failed to delete keys: %w", err)
+		}
+		sum += len(muts)
+	}
+}
+
+// Load stores fixtures, replacing existing entities, and fails the test on error.
+// The objects are returned with their keys resolved.
+func (e *Env[T]) Load(objs ...T) []T {
+	e.t.Helper()
+	if len(objs) == 0 {
+		return objs
+	}
+	_, objs, err := e.BatchPut(context.Background(), objs)
+	if err != nil {
+		e.t.Fatalf("load fixtures: %v", err)
+	}
+	return objs
+}
+
+// LoadJSON stores the fixtures of a JSON file, holding either an array of
+// objects or a single object, and fails the test on error.
+// The objects are decoded with encoding/json and stored with Load.
+func (e *Env[T]) LoadJSON(path string) []T {
+	e.t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		e.t.Fatalf("read fixtures: %v", err)
+	}
+	var objs []T
+	if trimmed := strings.TrimSpace(string(data)); strings.HasPrefix(trimmed, "[") {
+		err = json.Unmarshal(data, &objs)
+	} else {
+		var obj T
+		err = json.Unmarshal(data, &obj)
+		objs = []T{obj}
+	}
+	if err != nil {
+		e.t.Fatalf("decode fixtures %s: %v", path, err)
+	}
+	return e.Load(objs...)
+}
+
+// AssertExists asserts that the entity of obj exists, using Exists.
+func (e *Env[T]) AssertExists(obj T, msgAndArgs ...interface{}) bool {
+	e.t.Helper()
+	ok, err := e.Exists(context.Background(), obj)
+	if !assert.NoError(e.t, err, msgAndArgs...) {
+		return false
+	}
+	if !ok {
+		return assert.Fail(e.t, fmt.Sprintf("entity %s does not exist", e.keyString(obj)), msgAndArgs...)
+	}
+	return true
+}
+
+// AssertNotExists asserts that the entity of obj does not exist, using Exists.
+func (e *Env[T]) AssertNotExists(obj T, msgAndArgs ...interface{}) bool {
+	e.t.Helper()
+	ok, err := e.Exists(context.Background(), obj)
+	if !assert.NoError(e.t, err, msgAndArgs...) {
+		return false
+	}
+	if ok {
+		return assert.Fail(e.t, fmt.Sprintf("entity %s exists", e.keyString(obj)), msgAndArgs...)
+	}
+	return true
+}
+
+// AssertEntityEqual asserts that the entity with the key of expected, as
+// returned by Get, equals expected. The entity is loaded into a new T whose
+// key is resolved first, so fields that are not stored, e.g. tagged with
+// `datastore:"-"`, must be set in expected the way LoadKey and the AfterLoad
+// hook set them.
+func (e *Env[T]) AssertEntityEqual(expected T, msgAndArgs ...interface{}) bool {
+	e.t.Helper()
+	actual, err := e.load(context.Background(), expected)
+	if err != nil {
+		return assert.Fail(e.t, fmt.Sprintf("get entity %s: %v", e.keyString(expected), err), msgAndArgs...)
+	}
+	return assert.Equal(e.t, expected, actual, msgAndArgs...)
+}
+
+// load gets the entity with the key of obj into a new T, using Get. The key of
+// the new T is resolved with LoadKey, or copied from obj along with its other
+// fields if T does not implement datastore.KeyLoader.
+func (e *Env[T]) load(ctx context.Context, obj T) (T, error) {
+	key, err := obj.BuildKey(e.Namespace())
+	if err != nil {
+		return obj, err
+	}
+	actual := newObject[T]()
+	if _, ok := interface{}(actual).(datastore.KeyLoader); ok {
+		if err := e.ResolveKey(key, actual); err != nil {
+			return actual, err
+		}
+	} else {
+		actual = copyObject(obj)
+	}
+	return e.Get(ctx, actual)
+}
+
+// keyString formats the key of obj for assertion messages.
+func (e *Env[T]) keyString(obj T) string {
+	key, err := obj.BuildKey(e.Namespace())
+	if err != nil {
+		return fmt.Sprintf("(invalid key: %v)", err)
+	}
+	return key.String()
+}
+
+// copyObject returns a shallow copy of obj, copying the value obj points to if
+// it is a pointer.
+func copyObject[T any](obj T) T {
+	v := reflect.ValueOf(obj)
+	if !v.IsValid() || v.Kind() != reflect.Ptr || v.IsNil() {
+		return obj
+	}
+	c := reflect.New(v.Type().Elem())
+	c.Elem().Set(v.Elem())
+	return c.Interface().(T)
+}
+
+// newObject returns a new zero T, allocating the value T points to if it is a pointer.
+func newObject[T any]() T {
+	var obj T
+	if t := reflect.TypeOf(obj); t != nil && t.Kind() == reflect.Ptr {
+		return reflect.New(t.Elem()).Interface().(T)
+	}
+	return obj
+}
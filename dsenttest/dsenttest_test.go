@@ -0,0 +1,157 @@
+package dsenttest
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+	"pkg.lucas.icu/dsent"
+)
+
+type user struct {
+	ID        int64  `datastore:"-" json:"id"`
+	Name      string `datastore:"name" json:"name"`
+	Age       int    `datastore:"age" json:"age"`
+	LoadedKey int64  `datastore:"-" json:"-"`
+}
+
+func (x *user) BuildKey(ns string) (*datastore.Key, error) {
+	return dsent.SetNS(datastore.IDKey("User", x.ID, nil), ns), nil
+}
+
+func (x *user) LoadKey(k *datastore.Key) error {
+	x.ID = k.ID
+	x.LoadedKey = k.ID
+	return nil
+}
+
+func (x *user) Load(ps []datastore.Property) error {
+	return datastore.LoadStruct(x, ps)
+}
+
+func (x *user) Save() ([]datastore.Property, error) {
+	return datastore.SaveStruct(x)
+}
+
+type softUser struct {
+	ID      int64     `datastore:"-"`
+	Name    string    `datastore:"name"`
+	Deleted time.Time `datastore:"deleted_at"`
+}
+
+func (x *softUser) BuildKey(ns string) (*datastore.Key, error) {
+	return dsent.SetNS(datastore.IDKey("SoftUser", x.ID, nil), ns), nil
+}
+
+func (x *softUser) LoadKey(k *datastore.Key) error {
+	x.ID = k.ID
+	return nil
+}
+
+func (x *softUser) Load(ps []datastore.Property) error {
+	return datastore.LoadStruct(x, ps)
+}
+
+func (x *softUser) Save() ([]datastore.Property, error) {
+	return datastore.SaveStruct(x)
+}
+
+func (x *softUser) DeletedAt() time.Time {
+	return x.Deleted
+}
+
+func (x *softUser) SetDeletedAt(t time.Time) {
+	x.Deleted = t
+}
+
+// recorder records the failures of assertions instead of failing the test.
+type recorder struct {
+	testing.TB
+	failures []string
+}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.failures = append(r.failures, format)
+}
+
+func TestEnv(t *testing.T) {
+	env := New[*user](t, "User")
+	require.True(t, strings.HasPrefix(env.Namespace(), "TestEnv-"))
+
+	users := env.Load(&user{ID: 1, Name: "alice"}, &user{ID: 2, Name: "bob"})
+	require.Equal(t, int64(2), users[1].LoadedKey)
+
+	env.AssertExists(&user{ID: 1})
+	env.AssertNotExists(&user{ID: 3})
+	env.AssertEntityEqual(&user{ID: 1, Name: "alice", LoadedKey: 1})
+
+	r := &recorder{TB: t}
+	failing := &Env[*user]{DSEnt: env.DSEnt, t: r}
+	require.False(t, failing.AssertExists(&user{ID: 3}))
+	require.False(t, failing.AssertNotExists(&user{ID: 1}))
+	require.False(t, failing.AssertEntityEqual(&user{ID: 1, Name: "bob", LoadedKey: 1}))
+	require.False(t, failing.AssertEntityEqual(&user{ID: 3}))
+	// properties missing from the stored entity are not taken from expected
+	key := dsent.SetNS(datastore.IDKey("User", 4, nil), env.Namespace())
+	_, err := env.Backend().Mutate(context.Background(), dsent.NewUpsert(key, &datastore.PropertyList{{Name: "name", Value: "carol"}}))
+	require.NoError(t, err)
+	env.AssertEntityEqual(&user{ID: 4, Name: "carol", LoadedKey: 4})
+	require.False(t, failing.AssertEntityEqual(&user{ID: 4, Name: "carol", Age: 30, LoadedKey: 4}))
+	require.Len(t, r.failures, 5)
+}
+
+func TestEnvSoftDelete(t *testing.T) {
+	env := New[*softUser](t, "SoftUser", WithOptions(dsent.WithSoftDelete("deleted_at")))
+	env.Load(&softUser{ID: 1, Name: "alice"})
+	require.NoError(t, env.Delete(context.Background(), &softUser{ID: 1}))
+
+	// soft-deleted entities are not found, as with Get
+	env.AssertNotExists(&softUser{ID: 1})
+	r := &recorder{TB: t}
+	failing := &Env[*softUser]{DSEnt: env.DSEnt, t: r}
+	all, err := env.Query().WithDeleted().All(context.Background())
+	require.NoError(t, err)
+	require.Len(t, all, 1)
+	require.False(t, failing.AssertEntityEqual(all[0]))
+	require.Len(t, r.failures, 1)
+}
+
+func TestEnvLoadJSON(t *testing.T) {
+	env := New[*user](t, "User")
+	users := env.LoadJSON("testdata/users.json")
+	require.Len(t, users, 2)
+	env.AssertEntityEqual(&user{ID: 2, Name: "bob", Age: 25, LoadedKey: 2})
+}
+
+func TestEnvIsolation(t *testing.T) {
+	backend := dsent.NewMemoryBackend()
+	var ns string
+	t.Run("first", func(t *testing.T) {
+		env := New[*user](t, "User", WithBackend(backend))
+		ns = env.Namespace()
+		env.Load(&user{ID: 1})
+		env.AssertExists(&user{ID: 1})
+
+		other := New[*user](t, "User", WithBackend(backend))
+		require.NotEqual(t, ns, other.Namespace())
+		other.AssertNotExists(&user{ID: 1})
+	})
+
+	// the namespace was purged when the subtest completed
+	n, err := backend.Count(context.Background(), &dsent.QuerySpec{Namespace: ns, Limit: -1})
+	require.NoError(t, err)
+	require.Zero(t, n)
+}
+
+func TestUniqueNamespace(t *testing.T) {
+	t.Run("with spaces/and slashes é", func(t *testing.T) {
+		ns := UniqueNamespace(t)
+		require.Regexp(t, `^TestUniqueNamespace-with_spaces-and_slashes_-[0-9a-f]{8}$`, ns)
+	})
+	t.Run(strings.Repeat("x", 200), func(t *testing.T) {
+		require.Len(t, UniqueNamespace(t), maxNamespaceLen)
+	})
+}
@@ -0,0 +1,121 @@
+package dsent
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+)
+
+// BeforeCreator is implemented by objects that run code before being created,
+// by Create, BatchCreate, BulkCreate and the created branch of Update.
+// It runs before BeforeSave and before the key of the object is built.
+type BeforeCreator interface {
+	BeforeCreate(ctx context.Context) error
+}
+
+// BeforeSaver is implemented by objects that run code before every write:
+// creates, puts and updates. It runs before the key of the object is built.
+type BeforeSaver interface {
+	BeforeSave(ctx context.Context) error
+}
+
+// AfterSaver is implemented by objects that run code after every write.
+//
+// Non-transactional methods, and the methods running their own transaction
+// such as BatchPut or Update, run it once the write is committed and the key
+// resolved. The *Tx methods run it once the write is staged in the transaction,
+// which can still fail to commit.
+type AfterSaver interface {
+	AfterSave(ctx context.Context) error
+}
+
+// AfterLoader is implemented by objects that run code after being loaded by
+// Get, BatchGet, UpdateTx or a query, including when the error is an ErrFieldMismatch.
+type AfterLoader interface {
+	AfterLoad(ctx context.Context) error
+}
+
+// BeforeDeleter is implemented by objects that run code before being deleted.
+type BeforeDeleter interface {
+	BeforeDelete(ctx context.Context) error
+}
+
+// loaded reports whether an entity was loaded despite err.
+func loaded(err error) bool {
+	if err == nil {
+		return true
+	}
+	_, ok := err.(*datastore.ErrFieldMismatch)
+	return ok
+}
+
+// beforeWrite runs the BeforeCreate hook of obj for inserts, then its
+// BeforeSave hook, then validates it.
+func (db *DSEnt[T]) beforeWrite(ctx context.Context, op MutationOp, obj T) error {
+	inter := interface{}(obj)
+	if h, ok := inter.(BeforeCreator); ok && op == OpInsert {
+		if err := h.BeforeCreate(ctx); err != nil {
+			return err
+		}
+	}
+	if h, ok := inter.(BeforeSaver); ok {
+		if err := h.BeforeSave(ctx); err != nil {
+			return err
+		}
+	}
+	return db.validate(obj)
+}
+
+// afterSave runs the AfterSave hook of the objects.
+func (db *DSEnt[T]) afterSave(ctx context.Context, objs ...T) error {
+	for _, obj := range objs {
+		if h, ok := interface{}(obj).(AfterSaver); ok {
+			if err := h.AfterSave(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// afterLoad runs the AfterLoad hook of the objects.
+func (db *DSEnt[T]) afterLoad(ctx context.Context, objs ...T) error {
+	for _, obj := range objs {
+		if h, ok := interface{}(obj).(AfterLoader); ok {
+			if err := h.AfterLoad(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// beforeDelete runs the BeforeDelete hook of the objects.
+func (db *DSEnt[T]) beforeDelete(ctx context.Context, objs ...T) error {
+	for _, obj := range objs {
+		if h, ok := interface{}(obj).(BeforeDeleter); ok {
+			if err := h.BeforeDelete(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// afterLoadBatch runs the AfterLoad hook of the objects loaded by a batch get
+// that returned err, and returns err unless a hook fails.
+func (db *DSEnt[T]) afterLoadBatch(ctx context.Context, objs []T, err error) error {
+	berr, isBatch := err.(*BatchError[T])
+	if !isBatch && !loaded(err) {
+		return err
+	}
+	for i, obj := range objs {
+		if isBatch && !loaded(berr.Errs[i]) {
+			continue
+		}
+		if herr := db.afterLoad(ctx, obj); herr != nil {
+			return herr
+		}
+	}
+	return err
+}
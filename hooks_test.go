@@ -0,0 +1,247 @@
+package dsent
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	_ BeforeCreator = (*hookObj)(nil)
+	_ BeforeSaver   = (*hookObj)(nil)
+	_ AfterSaver    = (*hookObj)(nil)
+	_ AfterLoader   = (*hookObj)(nil)
+	_ BeforeDeleter = (*hookObj)(nil)
+)
+
+var errHook = errors.New("hook failed")
+
+type hookObj struct {
+	ID    int64  `datastore:"-"`
+	Name  string `datastore:"name"`
+	Saved string `datastore:"saved"`
+
+	// calls records the hooks called on the object.
+	calls []string
+	// fail is the name of the hook that returns errHook.
+	fail string
+}
+
+func (x *hookObj) BuildKey(ns string) (*datastore.Key, error) {
+	return SetNS(datastore.IDKey("Hook", x.ID, nil), ns), nil
+}
+
+func (x *hookObj) LoadKey(k *datastore.Key) error {
+	x.ID = k.ID
+	return nil
+}
+
+func (x *hookObj) Load(ps []datastore.Property) error {
+	return datastore.LoadStruct(x, ps)
+}
+
+func (x *hookObj) Save() ([]datastore.Property, error) {
+	return datastore.SaveStruct(x)
+}
+
+func (x *hookObj) call(name string) error {
+	x.calls = append(x.calls, name)
+	if x.fail == name {
+		return errHook
+	}
+	return nil
+}
+
+func (x *hookObj) BeforeCreate(ctx context.Context) error {
+	if x.ID == 0 {
+		// keys can be set by the hook
+		x.ID = 100
+	}
+	return x.call("BeforeCreate")
+}
+
+func (x *hookObj) BeforeSave(ctx context.Context) error {
+	x.Saved = x.Name
+	return x.call("BeforeSave")
+}
+
+func (x *hookObj) AfterSave(ctx context.Context) error {
+	return x.call("AfterSave")
+}
+
+func (x *hookObj) AfterLoad(ctx context.Context) error {
+	return x.call("AfterLoad")
+}
+
+func (x *hookObj) BeforeDelete(ctx context.Context) error {
+	return x.call("BeforeDelete")
+}
+
+func TestHooks(t *testing.T) {
+	ctx := context.Background()
+	db := newMemoryDSEnt[*hookObj](t, "Hook")
+
+	obj := &hookObj{Name: "a"}
+	key, _, err := db.Create(ctx, obj)
+	require.NoError(t, err)
+	require.Equal(t, int64(100), key.ID)
+	require.Equal(t, []string{"BeforeCreate", "BeforeSave", "AfterSave"}, obj.calls)
+
+	obj = &hookObj{ID: 1, Name: "b"}
+	_, _, err = db.Put(ctx, obj)
+	require.NoError(t, err)
+	require.Equal(t, []string{"BeforeSave", "AfterSave"}, obj.calls)
+
+	obj, err = db.Get(ctx, &hookObj{ID: 1})
+	require.NoError(t, err)
+	require.Equal(t, "b", obj.Saved)
+	require.Equal(t, []string{"AfterLoad"}, obj.calls)
+
+	objs, err := db.BatchGet(ctx, []*hookObj{{ID: 1}, {ID: 2}})
+	require.Error(t, err)
+	require.Equal(t, []string{"AfterLoad"}, objs[0].calls)
+	require.Empty(t, objs[1].calls)
+
+	obj, err = db.Update(ctx, &hookObj{ID: 1}, func(x *hookObj) (*hookObj, error) {
+		x.Name = "c"
+		return x, nil
+	}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"AfterLoad", "BeforeSave", "AfterSave"}, obj.calls)
+
+	obj, err = db.Update(ctx, &hookObj{ID: 2}, func(x *hookObj) (*hookObj, error) {
+		return x, nil
+	}, func(x *hookObj) (*hookObj, error) {
+		return x, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"BeforeCreate", "BeforeSave", "AfterSave"}, obj.calls)
+
+	// no hooks run when the update is aborted
+	obj, err = db.Update(ctx, &hookObj{ID: 2}, func(x *hookObj) (*hookObj, error) {
+		return x, ErrUpdateAbort
+	}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"AfterLoad"}, obj.calls)
+
+	all, err := db.Query().All(ctx)
+	require.NoError(t, err)
+	require.Len(t, all, 3)
+	for _, obj := range all {
+		require.Equal(t, []string{"AfterLoad"}, obj.calls)
+	}
+
+	obj = &hookObj{ID: 2}
+	require.NoError(t, db.Delete(ctx, obj))
+	require.Equal(t, []string{"BeforeDelete"}, obj.calls)
+
+	_, err = db.RunInTransaction(ctx, func(tx Tx) error {
+		obj, err := db.GetTx(tx, &hookObj{ID: 1})
+		require.NoError(t, err)
+		require.Equal(t, []string{"AfterLoad"}, obj.calls)
+		obj = &hookObj{ID: 3}
+		_, _, err = db.CreateTx(tx, obj)
+		require.NoError(t, err)
+		require.Equal(t, []string{"BeforeCreate", "BeforeSave", "AfterSave"}, obj.calls)
+		obj = &hookObj{ID: 100}
+		require.NoError(t, db.DeleteTx(tx, obj))
+		require.Equal(t, []string{"BeforeDelete"}, obj.calls)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestHooksAbort(t *testing.T) {
+	ctx := context.Background()
+	db := newMemoryDSEnt[*hookObj](t, "Hook")
+
+	_, _, err := db.Create(ctx, &hookObj{ID: 1, fail: "BeforeCreate"})
+	require.ErrorIs(t, err, errHook)
+	_, _, err = db.Put(ctx, &hookObj{ID: 1, fail: "BeforeSave"})
+	require.ErrorIs(t, err, errHook)
+	_, _, err = db.BatchPut(ctx, []*hookObj{{ID: 1}, {ID: 2, fail: "BeforeSave"}})
+	require.ErrorIs(t, err, errHook)
+	n, err := db.Query().Count(ctx)
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	// AfterSave errors are returned once the entity is written
+	_, _, err = db.Put(ctx, &hookObj{ID: 1, fail: "AfterSave"})
+	require.ErrorIs(t, err, errHook)
+	ok, err := db.Exists(ctx, &hookObj{ID: 1})
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// but abort transactions when staging
+	_, err = db.RunInTransaction(ctx, func(tx Tx) error {
+		_, _, err := db.PutTx(tx, &hookObj{ID: 2, fail: "AfterSave"})
+		return err
+	})
+	require.ErrorIs(t, err, errHook)
+	ok, err = db.Exists(ctx, &hookObj{ID: 2})
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	_, err = db.Get(ctx, &hookObj{ID: 1, fail: "AfterLoad"})
+	require.ErrorIs(t, err, errHook)
+	_, err = db.BatchGet(ctx, []*hookObj{{ID: 1, fail: "AfterLoad"}})
+	require.ErrorIs(t, err, errHook)
+
+	require.ErrorIs(t, db.Delete(ctx, &hookObj{ID: 1, fail: "BeforeDelete"}), errHook)
+	require.ErrorIs(t, db.BulkDelete(ctx, []*hookObj{{ID: 1, fail: "BeforeDelete"}}), errHook)
+	ok, err = db.Exists(ctx, &hookObj{ID: 1})
+	require.NoError(t, err)
+	require.True(t, ok)
+}
+
+// conflictBackend is a MemoryBackend whose transactions conflict on their first attempt.
+type conflictBackend struct {
+	*MemoryBackend
+	attempts int
+}
+
+func (b *conflictBackend) RunInTransaction(ctx context.Context, f func(tx Tx) error, opts ...datastore.TransactionOption) (Commit, error) {
+	b.attempts = 0
+	return b.MemoryBackend.RunInTransaction(ctx, func(tx Tx) error {
+		b.attempts++
+		if b.attempts == 1 {
+			// write a key read by the transaction before it commits
+			key := datastore.IDKey("Conflict", 1, nil)
+			if err := tx.Get(key, &hookObj{}); err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			if _, err := b.Mutate(ctx, &Mutation{Op: OpUpsert, Key: key, Src: &hookObj{}}); err != nil {
+				return err
+			}
+		}
+		return f(tx)
+	}, opts...)
+}
+
+func TestHooksRetry(t *testing.T) {
+	ctx := context.Background()
+	backend := &conflictBackend{MemoryBackend: NewMemoryBackend()}
+	db := newDSEnt[*hookObj](t, backend, "Hook")
+
+	// hooks run once, not once per attempt of the transaction
+	objs := []*hookObj{{ID: 1, Name: "a"}, {ID: 2, Name: "b"}}
+	_, _, err := db.BatchCreate(ctx, objs)
+	require.NoError(t, err)
+	require.Equal(t, 2, backend.attempts)
+	for _, obj := range objs {
+		require.Equal(t, []string{"BeforeCreate", "BeforeSave", "AfterSave"}, obj.calls)
+	}
+
+	objs = []*hookObj{{ID: 1, Name: "c"}}
+	_, _, err = db.BatchPut(ctx, objs)
+	require.NoError(t, err)
+	require.Equal(t, 2, backend.attempts)
+	require.Equal(t, []string{"BeforeSave", "AfterSave"}, objs[0].calls)
+
+	obj, err := db.Get(ctx, &hookObj{ID: 1})
+	require.NoError(t, err)
+	require.Equal(t, "c", obj.Saved)
+}
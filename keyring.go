@@ -0,0 +1,159 @@
+package dsent
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ErrUnknownCursorKey is returned when a cursor token was encrypted with a key
+// that is not, or no longer, in the keyring.
+var ErrUnknownCursorKey = fmt.Errorf("%w: unknown key", ErrInvalidCursor)
+
+// cursorTokenV2 is the version byte of keyring tokens, which embed the key ID.
+const cursorTokenV2 byte = 2
+
+// Keyring encrypts cursor tokens with its active key and decrypts them with
+// any of its keys, so that secrets can be rotated without invalidating the
+// tokens already handed out to clients.
+//
+// Tokens carry the ID of the key they were encrypted with. Version 1 tokens
+// produced by a CursorCodec are accepted too and tried against every key.
+// A Keyring is safe for concurrent use.
+type Keyring struct {
+	mu       sync.RWMutex
+	activeID string
+	codecs   map[string]*CursorCodec
+}
+
+// NewKeyring creates a keyring whose active key has the given ID and secret.
+func NewKeyring(id string, secret string) (*Keyring, error) {
+	if err := validateKeyID(id); err != nil {
+		return nil, err
+	}
+	return &Keyring{
+		activeID: id,
+		codecs:   map[string]*CursorCodec{id: NewCursorCodec(secret)},
+	}, nil
+}
+
+// validateKeyID checks that a key ID fits in a token header.
+func validateKeyID(id string) error {
+	if id == "" {
+		return errors.New("empty key id")
+	} else if len(id) > 255 {
+		return fmt.Errorf("key id too long: %d bytes", len(id))
+	}
+	return nil
+}
+
+// Add adds a retired key, which is used for decryption only.
+func (k *Keyring) Add(id string, secret string) error {
+	if err := validateKeyID(id); err != nil {
+		return err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.codecs[id]; ok {
+		return fmt.Errorf("key already in keyring: %s", id)
+	}
+	k.codecs[id] = NewCursorCodec(secret)
+	return nil
+}
+
+// Rotate adds a new key and makes it the active one.
+// The previously active key is retired but still used for decryption.
+func (k *Keyring) Rotate(id string, secret string) error {
+	if err := k.Add(id, secret); err != nil {
+		return err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.activeID = id
+	return nil
+}
+
+// Remove removes a retired key. Tokens encrypted with it are rejected afterwards.
+func (k *Keyring) Remove(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if id == k.activeID {
+		return fmt.Errorf("cannot remove the active key: %s", id)
+	}
+	delete(k.codecs, id)
+	return nil
+}
+
+// ActiveID returns the ID of the active key.
+func (k *Keyring) ActiveID() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.activeID
+}
+
+// IDs returns the sorted IDs of all keys in the keyring.
+func (k *Keyring) IDs() []string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	ids := make([]string, 0, len(k.codecs))
+	for id := range k.codecs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Encode encrypts and authenticates msg with the active key.
+func (k *Keyring) Encode(msg []byte) (string, error) {
+	k.mu.RLock()
+	id, codec := k.activeID, k.codecs[k.activeID]
+	k.mu.RUnlock()
+
+	header := make([]byte, 0, 2+len(id))
+	header = append(header, cursorTokenV2, byte(len(id)))
+	header = append(header, id...)
+	buf, err := codec.seal(header, msg)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Decode verifies and decrypts a token encrypted with any key of the keyring.
+// Keyrings never accept legacy tokens, so legacy is always false.
+func (k *Keyring) Decode(token string) (msg []byte, legacy bool, err error) {
+	buf, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	if len(buf) == 0 {
+		return nil, false, fmt.Errorf("%w: token too short", ErrInvalidCursor)
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	switch buf[0] {
+	case cursorTokenV1:
+		for _, codec := range k.codecs {
+			if msg, err = codec.open(buf[:1], buf); err == nil {
+				return msg, false, nil
+			}
+		}
+		return nil, false, err
+	case cursorTokenV2:
+		if len(buf) < 2 || len(buf) < 2+int(buf[1]) {
+			return nil, false, fmt.Errorf("%w: token too short", ErrInvalidCursor)
+		}
+		header := buf[:2+int(buf[1])]
+		codec, ok := k.codecs[string(header[2:])]
+		if !ok {
+			return nil, false, ErrUnknownCursorKey
+		}
+		msg, err = codec.open(header, buf)
+		return msg, false, err
+	default:
+		return nil, false, fmt.Errorf("%w: unknown token version %d", ErrInvalidCursor, buf[0])
+	}
+}
@@ -0,0 +1,106 @@
+package dsent
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	_ TokenCodec = (*CursorCodec)(nil)
+	_ TokenCodec = (*Keyring)(nil)
+)
+
+func TestKeyringRotate(t *testing.T) {
+	ring, err := NewKeyring("k1", "secret1")
+	require.NoError(t, err)
+
+	old, err := ring.Encode([]byte("old"))
+	require.NoError(t, err)
+
+	require.NoError(t, ring.Rotate("k2", "secret2"))
+	require.Equal(t, "k2", ring.ActiveID())
+	require.Equal(t, []string{"k1", "k2"}, ring.IDs())
+
+	current, err := ring.Encode([]byte("current"))
+	require.NoError(t, err)
+
+	msg, legacy, err := ring.Decode(old)
+	require.NoError(t, err)
+	require.False(t, legacy)
+	require.Equal(t, "old", string(msg))
+
+	msg, _, err = ring.Decode(current)
+	require.NoError(t, err)
+	require.Equal(t, "current", string(msg))
+
+	// the new token is only decryptable with the new key
+	_, _, err = NewCursorCodec("secret1").Decode(current)
+	require.ErrorIs(t, err, ErrInvalidCursor)
+
+	require.Error(t, ring.Remove("k2"))
+	require.NoError(t, ring.Remove("k1"))
+	_, _, err = ring.Decode(old)
+	require.ErrorIs(t, err, ErrUnknownCursorKey)
+	require.ErrorIs(t, err, ErrInvalidCursor)
+}
+
+func TestKeyringErrors(t *testing.T) {
+	_, err := NewKeyring("", "secret")
+	require.Error(t, err)
+
+	ring, err := NewKeyring("k1", "secret1")
+	require.NoError(t, err)
+	require.Error(t, ring.Add("k1", "secret"))
+	require.Error(t, ring.Rotate("k1", "secret"))
+	require.NoError(t, ring.Add("k0", "secret0"))
+	require.Equal(t, "k1", ring.ActiveID())
+
+	token, err := ring.Encode([]byte("test"))
+	require.NoError(t, err)
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	require.NoError(t, err)
+
+	// switching the key ID to another known key must not authenticate
+	tampered := append([]byte(nil), raw...)
+	tampered[3] = '0'
+	_, _, err = ring.Decode(base64.RawURLEncoding.EncodeToString(tampered))
+	require.ErrorIs(t, err, ErrCursorAuth)
+
+	for _, n := range []int{0, 1, 2, 4, 20} {
+		_, _, err = ring.Decode(base64.RawURLEncoding.EncodeToString(raw[:n]))
+		require.ErrorIs(t, err, ErrInvalidCursor)
+	}
+}
+
+func TestKeyringVersion1(t *testing.T) {
+	token, err := NewCursorCodec("secret0").Encode([]byte("v1"))
+	require.NoError(t, err)
+
+	ring, err := NewKeyring("k1", "secret1")
+	require.NoError(t, err)
+	_, _, err = ring.Decode(token)
+	require.ErrorIs(t, err, ErrCursorAuth)
+
+	require.NoError(t, ring.Add("k0", "secret0"))
+	msg, _, err := ring.Decode(token)
+	require.NoError(t, err)
+	require.Equal(t, "v1", string(msg))
+}
+
+func TestKeyringPageCursor(t *testing.T) {
+	ring, err := NewKeyring("k1", "secret1")
+	require.NoError(t, err)
+	db := NewDSEnt[*exampleObj](nil, "ns", "Test", WithCursorCodec(ring))
+	c, err := datastore.DecodeCursor("Y3Vyc29y")
+	require.NoError(t, err)
+
+	token, err := db.encodeCursor(db.Query(), c)
+	require.NoError(t, err)
+	require.NoError(t, ring.Rotate("k2", "secret2"))
+	decoded, err := db.decodeCursor(db.Query(), token)
+	require.NoError(t, err)
+	require.Equal(t, c.String(), decoded.String())
+}
@@ -1,17 +1,194 @@
-// RegisterKind registers a new kind with the given name.
-// It checks if the kind is already registered and panics if it is.
 package dsent
 
-import "sync"
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
 
-var registeredKinds = map[string]bool{}
-var lock sync.Mutex
+// ErrKindRegistered is returned when registering a kind that is already registered.
+var ErrKindRegistered = errors.New("kind already registered")
 
-func RegisterKind(name string) {
-	lock.Lock()
-	defer lock.Unlock()
-	if registeredKinds[name] {
-		panic("kind already registered: " + name)
+// KeyStrategy describes how the keys of a kind are built.
+type KeyStrategy int
+
+const (
+	// KeyUnspecified means the key strategy of the kind is unknown.
+	KeyUnspecified KeyStrategy = iota
+	// KeyID means keys have a numeric ID chosen by the application.
+	KeyID
+	// KeyName means keys have a string name chosen by the application.
+	KeyName
+	// KeyAutoID means keys are incomplete and their ID is allocated by Datastore.
+	KeyAutoID
+)
+
+func (s KeyStrategy) String() string {
+	switch s {
+	case KeyID:
+		return "id"
+	case KeyName:
+		return "name"
+	case KeyAutoID:
+		return "auto-id"
+	default:
+		return "unspecified"
+	}
+}
+
+// NamespacePolicy restricts the namespaces a kind can be used in.
+type NamespacePolicy struct {
+	// Allowed lists the allowed namespaces, "" being the default namespace.
+	// An empty list allows any namespace.
+	Allowed []string
+}
+
+// Allows reports whether the kind can be used in namespace ns.
+func (p NamespacePolicy) Allows(ns string) bool {
+	if len(p.Allowed) == 0 {
+		return true
+	}
+	for _, allowed := range p.Allowed {
+		if allowed == ns {
+			return true
+		}
+	}
+	return false
+}
+
+// KindInfo is the metadata of a kind.
+type KindInfo struct {
+	// Name is the name of the kind.
+	Name string
+	// Type is the Go type of the entities of the kind, e.g. reflect.TypeOf(&User{}).
+	// When set, NewDSEnt only accepts that type for the kind.
+	Type reflect.Type
+	// KeyStrategy is how the keys of the kind are built.
+	KeyStrategy KeyStrategy
+	// Namespaces is the namespace policy enforced by NewDSEnt.
+	Namespaces NamespacePolicy
+	// SchemaVersion is the version of the schema of the entities.
+	SchemaVersion int
+}
+
+// kindEntry is a registered kind.
+type kindEntry struct {
+	info KindInfo
+	// implicit is set for kinds registered by NewDSEnt rather than by Register.
+	implicit bool
+}
+
+// Registry records the kinds used by a service along with their metadata.
+// Create isolated registries with NewRegistry, e.g. one per test, and pass
+// them to NewDSEnt with WithRegistry. A Registry is safe for concurrent use.
+type Registry struct {
+	mu    sync.RWMutex
+	kinds map[string]*kindEntry
+}
+
+// DefaultRegistry is the registry used by RegisterKind and, unless
+// WithRegistry is given, by NewDSEnt.
+var DefaultRegistry = NewRegistry()
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{kinds: map[string]*kindEntry{}}
+}
+
+// Register registers a kind with its metadata.
+// It returns ErrKindRegistered if the kind is already registered.
+//
+// A kind that was only registered implicitly by NewDSEnt can still be
+// registered once. info replaces the implicit metadata: if info does not set
+// a Type, the kind accepts any type.
+func (r *Registry) Register(info KindInfo) error {
+	if info.Name == "" {
+		return errors.New("empty kind name")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.kinds[info.Name]; ok && !e.implicit {
+		return fmt.Errorf("%w: %s", ErrKindRegistered, info.Name)
 	}
-	registeredKinds[name] = true
+	r.kinds[info.Name] = &kindEntry{info: info}
+	return nil
+}
+
+// MustRegister is like Register but panics if the kind cannot be registered.
+func (r *Registry) MustRegister(info KindInfo) {
+	if err := r.Register(info); err != nil {
+		panic(err.Error())
+	}
+}
+
+// Unregister removes a kind from the registry and reports whether it was registered.
+func (r *Registry) Unregister(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.kinds[name]
+	delete(r.kinds, name)
+	return ok
+}
+
+// Reset removes all kinds from the registry.
+func (r *Registry) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.kinds = map[string]*kindEntry{}
+}
+
+// Lookup returns the metadata of a kind.
+func (r *Registry) Lookup(name string) (KindInfo, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	e, ok := r.kinds[name]
+	if !ok {
+		return KindInfo{}, false
+	}
+	return e.info, true
+}
+
+// Kinds returns the metadata of all registered kinds sorted by name.
+func (r *Registry) Kinds() []KindInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	kinds := make([]KindInfo, 0, len(r.kinds))
+	for _, e := range r.kinds {
+		kinds = append(kinds, e.info)
+	}
+	sort.Slice(kinds, func(i, j int) bool {
+		return kinds[i].Name < kinds[j].Name
+	})
+	return kinds
+}
+
+// use registers kind implicitly if needed and validates that it can be
+// used with Go type typ in namespace ns.
+func (r *Registry) use(kind string, typ reflect.Type, ns string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.kinds[kind]
+	if !ok {
+		r.kinds[kind] = &kindEntry{
+			info:     KindInfo{Name: kind, Type: typ},
+			implicit: true,
+		}
+		return nil
+	}
+	if !e.info.Namespaces.Allows(ns) {
+		return fmt.Errorf("kind %s is not allowed in namespace %q", kind, ns)
+	}
+	if !e.implicit && e.info.Type != nil && e.info.Type != typ {
+		return fmt.Errorf("kind %s is registered with type %s, not %s", kind, e.info.Type, typ)
+	}
+	return nil
+}
+
+// RegisterKind registers a new kind with the given name in the DefaultRegistry.
+// It checks if the kind is already registered and panics if it is.
+// Use DefaultRegistry.Register to get an error instead.
+func RegisterKind(name string) {
+	DefaultRegistry.MustRegister(KindInfo{Name: name})
 }
@@ -0,0 +1,100 @@
+package dsent
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	require.NoError(t, r.Register(KindInfo{
+		Name:          "User",
+		Type:          reflect.TypeOf(&exampleObj{}),
+		KeyStrategy:   KeyID,
+		Namespaces:    NamespacePolicy{Allowed: []string{"", "tenant"}},
+		SchemaVersion: 2,
+	}))
+	require.NoError(t, r.Register(KindInfo{Name: "Account", KeyStrategy: KeyName}))
+	require.ErrorIs(t, r.Register(KindInfo{Name: "User"}), ErrKindRegistered)
+	require.PanicsWithValue(t, "kind already registered: User", func() { r.MustRegister(KindInfo{Name: "User"}) })
+	require.Error(t, r.Register(KindInfo{}))
+
+	info, ok := r.Lookup("User")
+	require.True(t, ok)
+	require.Equal(t, KeyID, info.KeyStrategy)
+	require.Equal(t, 2, info.SchemaVersion)
+	_, ok = r.Lookup("Unknown")
+	require.False(t, ok)
+
+	kinds := r.Kinds()
+	require.Len(t, kinds, 2)
+	require.Equal(t, "Account", kinds[0].Name)
+	require.Equal(t, "User", kinds[1].Name)
+
+	typ := reflect.TypeOf(&exampleObj{})
+	require.NoError(t, r.use("User", typ, "tenant"))
+	require.Error(t, r.use("User", typ, "other"))
+	require.Error(t, r.use("User", reflect.TypeOf(&objDropMissingKey{}), ""))
+	// Account has no type, any type is accepted
+	require.NoError(t, r.use("Account", typ, "other"))
+}
+
+func TestRegistryImplicit(t *testing.T) {
+	r := NewRegistry()
+	typ := reflect.TypeOf(&exampleObj{})
+	require.NoError(t, r.use("Implicit", typ, "ns"))
+	info, ok := r.Lookup("Implicit")
+	require.True(t, ok)
+	require.Equal(t, typ, info.Type)
+
+	// implicitly registered kinds accept other types
+	require.NoError(t, r.use("Implicit", reflect.TypeOf(&objDropMissingKey{}), "ns"))
+
+	// and can be registered explicitly once
+	require.NoError(t, r.Register(KindInfo{Name: "Implicit", Type: typ, KeyStrategy: KeyID}))
+	info, _ = r.Lookup("Implicit")
+	require.Equal(t, typ, info.Type)
+	require.Equal(t, KeyID, info.KeyStrategy)
+	require.ErrorIs(t, r.Register(KindInfo{Name: "Implicit"}), ErrKindRegistered)
+	require.Error(t, r.use("Implicit", reflect.TypeOf(&objDropMissingKey{}), "ns"))
+
+	// an explicit registration without a type accepts any type,
+	// whether or not the kind was used before
+	require.NoError(t, r.use("Untyped", typ, "ns"))
+	require.NoError(t, r.Register(KindInfo{Name: "Untyped"}))
+	info, _ = r.Lookup("Untyped")
+	require.Nil(t, info.Type)
+	require.NoError(t, r.use("Untyped", reflect.TypeOf(&objDropMissingKey{}), "ns"))
+}
+
+func TestNewDSEntRegistersKind(t *testing.T) {
+	t.Cleanup(func() {
+		DefaultRegistry.Unregister("RegistryTest")
+		DefaultRegistry.Unregister("RegistryTestKind")
+		DefaultRegistry.Unregister("RegistryTestTenant")
+	})
+
+	NewDSEnt[*exampleObj](nil, "ns", "RegistryTest")
+	info, ok := DefaultRegistry.Lookup("RegistryTest")
+	require.True(t, ok)
+	require.Equal(t, reflect.TypeOf(&exampleObj{}), info.Type)
+
+	RegisterKind("RegistryTestKind")
+	require.Panics(t, func() { RegisterKind("RegistryTestKind") })
+
+	DefaultRegistry.MustRegister(KindInfo{
+		Name:       "RegistryTestTenant",
+		Namespaces: NamespacePolicy{Allowed: []string{"tenant"}},
+	})
+	require.NotPanics(t, func() { NewDSEnt[*exampleObj](nil, "tenant", "RegistryTestTenant") })
+	require.Panics(t, func() { NewDSEnt[*exampleObj](nil, "other", "RegistryTestTenant") })
+
+	db, err := TryNewDSEnt[*exampleObj](nil, "other", "RegistryTestTenant")
+	require.Error(t, err)
+	require.Nil(t, db)
+	db, err = TryNewDSEntWithBackend[*exampleObj](NewMemoryBackend(), "tenant", "RegistryTestTenant")
+	require.NoError(t, err)
+	require.Equal(t, "tenant", db.Namespace())
+}
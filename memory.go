@@ -0,0 +1,935 @@
+package dsent
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// memoryCursorPrefix prefixes the position encoded in the cursors of a MemoryBackend.
+const memoryCursorPrefix = "memory:"
+
+// memoryMaxAttempts is the number of attempts of a MemoryBackend transaction,
+// the same default as the Datastore client.
+const memoryMaxAttempts = 3
+
+// MemoryBackend is a Backend that keeps entities in memory, e.g. to test code
+// built on DSEnt without the Datastore emulator.
+//
+// It honors namespaces, ancestors, the difference between inserts, upserts and
+// updates, the limits on the number of entities per call, and returns the same
+// errors as Datastore. Queries support the
+// operators of datastore.Query.FilterField and skip properties saved with
+// noindex. Transactions are optimistic: a transaction fails to commit with
+// datastore.ErrConcurrentTransaction, and is retried, when an entity it read
+// was written in the meantime. Transaction options are ignored.
+//
+// Entities can only be loaded into and saved from datastore.PropertyLoadSaver
+// values, which all DSEnt objects are.
+type MemoryBackend struct {
+	mu       sync.Mutex
+	entities map[string]*memoryEntity
+	// versions records the last write of every key, including deleted ones.
+	versions map[string]int64
+	version  int64
+	lastID   int64
+}
+
+// memoryEntity is an entity stored in a MemoryBackend.
+type memoryEntity struct {
+	key   *datastore.Key
+	props []datastore.Property
+}
+
+// memoryMutation is a mutation whose entity has already been saved.
+type memoryMutation struct {
+	op      MutationOp
+	key     *datastore.Key
+	props   []datastore.Property
+	pending *memoryPendingKey
+}
+
+// memoryPendingKey is the reference of the pending keys of a MemoryBackend.
+type memoryPendingKey struct {
+	key *datastore.Key
+}
+
+// NewMemoryBackend creates an empty MemoryBackend.
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		entities: map[string]*memoryEntity{},
+		versions: map[string]int64{},
+	}
+}
+
+// keyString returns a string identifying key, including its namespace.
+func keyString(key *datastore.Key) string {
+	var path []*datastore.Key
+	for k := key; k != nil; k = k.Parent {
+		path = append(path, k)
+	}
+	var b strings.Builder
+	b.WriteString(strconv.Quote(key.Namespace))
+	for i := len(path) - 1; i >= 0; i-- {
+		b.WriteString("/")
+		b.WriteString(strconv.Quote(path[i].Kind))
+		if path[i].Name != "" {
+			b.WriteString(",n")
+			b.WriteString(strconv.Quote(path[i].Name))
+		} else {
+			b.WriteString(",i")
+			b.WriteString(strconv.FormatInt(path[i].ID, 10))
+		}
+	}
+	return b.String()
+}
+
+// validateMemoryKey checks that key is valid, the same way as Datastore does.
+func validateMemoryKey(key *datastore.Key, allowIncomplete bool) error {
+	if key == nil {
+		return datastore.ErrInvalidKey
+	}
+	for k := key; k != nil; k = k.Parent {
+		if k.Kind == "" || (k.Name != "" && k.ID != 0) || k.ID < 0 || k.Namespace != key.Namespace {
+			return datastore.ErrInvalidKey
+		}
+		if k.Incomplete() && (k != key || !allowIncomplete) {
+			return datastore.ErrInvalidKey
+		}
+	}
+	return nil
+}
+
+// copyKey returns a deep copy of key.
+func copyKey(key *datastore.Key) *datastore.Key {
+	if key == nil {
+		return nil
+	}
+	k := *key
+	k.Parent = copyKey(key.Parent)
+	return &k
+}
+
+// copyProperties returns a copy of props that shares no mutable values with it.
+func copyProperties(props []datastore.Property) []datastore.Property {
+	if props == nil {
+		return nil
+	}
+	out := make([]datastore.Property, len(props))
+	for i, p := range props {
+		out[i] = p
+		out[i].Value = copyValue(p.Value)
+	}
+	return out
+}
+
+// copyValue returns a copy of a property value that shares no mutable values with it.
+func copyValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []byte:
+		return append([]byte(nil), v...)
+	case *datastore.Key:
+		return copyKey(v)
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, x := range v {
+			out[i] = copyValue(x)
+		}
+		return out
+	case *datastore.Entity:
+		if v == nil {
+			return v
+		}
+		return &datastore.Entity{Key: copyKey(v.Key), Properties: copyProperties(v.Properties)}
+	default:
+		return v
+	}
+}
+
+// loadMemoryEntity loads an entity into dst, which must be a PropertyLoadSaver.
+func loadMemoryEntity(dst interface{}, e *memoryEntity) error {
+	pls, ok := dst.(datastore.PropertyLoadSaver)
+	if !ok || pls == nil {
+		return datastore.ErrInvalidEntityType
+	}
+	err := pls.Load(copyProperties(e.props))
+	if kl, ok := dst.(datastore.KeyLoader); ok {
+		if kerr := kl.LoadKey(copyKey(e.key)); err == nil {
+			err = kerr
+		}
+	}
+	return err
+}
+
+// multiDst returns the n elements of a GetMulti dst slice as PropertyLoadSavers.
+func multiDst(dst interface{}, n int) ([]interface{}, error) {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Slice {
+		return nil, datastore.ErrInvalidEntityType
+	} else if v.Len() != n {
+		return nil, errors.New("datastore: keys and dst slices have different length")
+	}
+	elems := make([]interface{}, n)
+	for i := range elems {
+		e := v.Index(i)
+		switch {
+		case e.Kind() == reflect.Ptr && e.IsNil():
+			e.Set(reflect.New(e.Type().Elem()))
+			elems[i] = e.Interface()
+		case e.Kind() == reflect.Ptr || e.Kind() == reflect.Interface:
+			elems[i] = e.Interface()
+		default:
+			elems[i] = e.Addr().Interface()
+		}
+	}
+	return elems, nil
+}
+
+// stage validates mutations and saves their entities.
+func (b *MemoryBackend) stage(muts []*Mutation) ([]*memoryMutation, error) {
+	staged := make([]*memoryMutation, len(muts))
+	for i, mut := range muts {
+		insertable := mut.Op == OpInsert || mut.Op == OpUpsert
+		if err := validateMemoryKey(mut.Key, insertable); err != nil {
+			return nil, err
+		}
+		m := &memoryMutation{op: mut.Op, key: copyKey(mut.Key)}
+		switch mut.Op {
+		case OpInsert, OpUpsert, OpUpdate:
+			if mut.Src == nil {
+				return nil, datastore.ErrInvalidEntityType
+			}
+			props, err := mut.Src.Save()
+			if err != nil {
+				return nil, err
+			}
+			m.props = copyProperties(props)
+		case OpDelete:
+		default:
+			return nil, fmt.Errorf("invalid mutation: %s", mut.Op)
+		}
+		staged[i] = m
+	}
+	return staged, nil
+}
+
+// apply applies staged mutations atomically and returns their complete keys.
+// b.mu must be held.
+func (b *MemoryBackend) apply(muts []*memoryMutation) ([]*datastore.Key, error) {
+	if len(muts) > MaxMutations {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot write more than %d entities in a single call", MaxMutations)
+	}
+	exists := map[string]bool{}
+	for _, m := range muts {
+		if m.key.Incomplete() {
+			continue
+		}
+		ks := keyString(m.key)
+		found, ok := exists[ks]
+		if !ok {
+			_, found = b.entities[ks]
+		}
+		switch {
+		case m.op == OpInsert && found:
+			return nil, status.Errorf(codes.AlreadyExists, "entity already exists: %v", m.key)
+		case m.op == OpUpdate && !found:
+			return nil, status.Errorf(codes.NotFound, "no entity to update: %v", m.key)
+		}
+		exists[ks] = m.op != OpDelete
+	}
+
+	keys := make([]*datastore.Key, len(muts))
+	for i, m := range muts {
+		key := copyKey(m.key)
+		if key.Incomplete() {
+			key.ID = b.allocateID(key)
+		}
+		ks := keyString(key)
+		if m.op == OpDelete {
+			if _, ok := b.entities[ks]; ok {
+				delete(b.entities, ks)
+				b.version++
+				b.versions[ks] = b.version
+			}
+		} else {
+			b.entities[ks] = &memoryEntity{key: key, props: m.props}
+			b.version++
+			b.versions[ks] = b.version
+		}
+		if m.pending != nil {
+			m.pending.key = copyKey(key)
+		}
+		keys[i] = key
+	}
+	return keys, nil
+}
+
+// allocateID returns an unused ID for an incomplete key. b.mu must be held.
+func (b *MemoryBackend) allocateID(key *datastore.Key) int64 {
+	for {
+		b.lastID++
+		key.ID = b.lastID
+		if _, ok := b.versions[keyString(key)]; !ok {
+			return b.lastID
+		}
+	}
+}
+
+// lookup returns the entity stored for key and the version of key.
+func (b *MemoryBackend) lookup(key *datastore.Key) (*memoryEntity, int64, error) {
+	if err := validateMemoryKey(key, false); err != nil {
+		return nil, 0, err
+	}
+	ks := keyString(key)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.entities[ks], b.versions[ks], nil
+}
+
+// get loads the entity stored for key into dst and returns the version of key.
+func (b *MemoryBackend) get(key *datastore.Key, dst interface{}) (int64, error) {
+	e, version, err := b.lookup(key)
+	if err != nil {
+		return version, err
+	} else if e == nil {
+		return version, datastore.ErrNoSuchEntity
+	}
+	return version, loadMemoryEntity(dst, e)
+}
+
+// getMulti loads the entities stored for keys into dst and returns the versions of keys.
+func (b *MemoryBackend) getMulti(keys []*datastore.Key, dst interface{}) ([]int64, error) {
+	if len(keys) > MaxLookupKeys {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot get more than %d keys in a single call", MaxLookupKeys)
+	}
+	elems, err := multiDst(dst, len(keys))
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]int64, len(keys))
+	merr := make(datastore.MultiError, len(keys))
+	failed := false
+	for i, key := range keys {
+		if versions[i], merr[i] = b.get(key, elems[i]); merr[i] != nil {
+			failed = true
+		}
+	}
+	if failed {
+		return versions, merr
+	}
+	return versions, nil
+}
+
+func (b *MemoryBackend) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err := b.get(key, dst)
+	return err
+}
+
+func (b *MemoryBackend) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err := b.getMulti(keys, dst)
+	return err
+}
+
+func (b *MemoryBackend) Mutate(ctx context.Context, muts ...*Mutation) ([]*datastore.Key, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	staged, err := b.stage(muts)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.apply(staged)
+}
+
+func (b *MemoryBackend) RunInTransaction(ctx context.Context, f func(tx Tx) error, opts ...datastore.TransactionOption) (Commit, error) {
+	for attempt := 0; attempt < memoryMaxAttempts; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		tx := &memoryTx{b: b, ctx: ctx, reads: map[string]int64{}}
+		if err := f(tx); err != nil {
+			return nil, err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := b.commit(tx); err == datastore.ErrConcurrentTransaction {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return memoryCommit{}, nil
+	}
+	return nil, datastore.ErrConcurrentTransaction
+}
+
+// commit applies the mutations of tx unless an entity it read has been written since.
+func (b *MemoryBackend) commit(tx *memoryTx) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ks, version := range tx.reads {
+		if b.versions[ks] != version {
+			return datastore.ErrConcurrentTransaction
+		}
+	}
+	_, err := b.apply(tx.muts)
+	return err
+}
+
+func (b *MemoryBackend) GetAll(ctx context.Context, q *QuerySpec, dst interface{}) ([]*datastore.Key, error) {
+	keys, _, err := b.Run(ctx, q, dst)
+	return keys, err
+}
+
+func (b *MemoryBackend) Run(ctx context.Context, q *QuerySpec, dst interface{}) ([]*datastore.Key, datastore.Cursor, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, datastore.Cursor{}, err
+	}
+	results, end, err := b.query(q)
+	if err != nil {
+		return nil, datastore.Cursor{}, err
+	}
+	keys, err := loadMemoryResults(results, q.KeysOnly, dst)
+	if keys == nil && err != nil {
+		return nil, datastore.Cursor{}, err
+	}
+	c, cerr := datastore.DecodeCursor(base64.RawURLEncoding.EncodeToString([]byte(memoryCursorPrefix + strconv.Itoa(end))))
+	if cerr != nil {
+		return nil, datastore.Cursor{}, cerr
+	}
+	return keys, c, err
+}
+
+func (b *MemoryBackend) Count(ctx context.Context, q *QuerySpec) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	results, _, err := b.query(q)
+	return len(results), err
+}
+
+// Close does nothing, the entities are kept.
+func (b *MemoryBackend) AllocateIDs(ctx context.Context, keys []*datastore.Key) ([]*datastore.Key, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if err := validateMemoryKey(key, true); err != nil {
+			return nil, err
+		} else if !key.Incomplete() {
+			return nil, status.Errorf(codes.InvalidArgument, "cannot allocate an ID for a complete key: %v", key)
+		}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	allocated := make([]*datastore.Key, len(keys))
+	for i, key := range keys {
+		allocated[i] = copyKey(key)
+		b.allocateID(allocated[i])
+	}
+	return allocated, nil
+}
+
+func (b *MemoryBackend) Close() error {
+	return nil
+}
+
+// loadMemoryResults loads query results into dst, a pointer to a slice or nil.
+// Like the Datastore client, it returns the keys along with the first ErrFieldMismatch.
+func loadMemoryResults(results []*memoryEntity, keysOnly bool, dst interface{}) ([]*datastore.Key, error) {
+	var slice reflect.Value
+	if dst != nil && !keysOnly {
+		slice = reflect.ValueOf(dst)
+		if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+			return nil, datastore.ErrInvalidEntityType
+		}
+		slice = slice.Elem()
+	}
+	keys := make([]*datastore.Key, 0, len(results))
+	var mismatchErr error
+	for _, e := range results {
+		keys = append(keys, copyKey(e.key))
+		if !slice.IsValid() {
+			continue
+		}
+		elemType := slice.Type().Elem()
+		elem := newSliceElem(elemType)
+		if err := loadMemoryEntity(elem.Interface(), e); err != nil {
+			if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+				return nil, err
+			}
+			if mismatchErr == nil {
+				mismatchErr = err
+			}
+		}
+		slice.Set(reflect.Append(slice, derefSliceElem(elem, elemType)))
+	}
+	return keys, mismatchErr
+}
+
+// memoryCursorPosition decodes the position of a cursor returned by Run.
+func memoryCursorPosition(c datastore.Cursor) (int, error) {
+	s := c.String()
+	if s == "" {
+		return 0, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil && strings.HasPrefix(string(raw), memoryCursorPrefix) {
+		var pos int
+		if pos, err = strconv.Atoi(strings.TrimPrefix(string(raw), memoryCursorPrefix)); err == nil && pos >= 0 {
+			return pos, nil
+		}
+	}
+	return 0, status.Errorf(codes.InvalidArgument, "invalid cursor: %s", s)
+}
+
+// query returns the entities matching q after its start cursor, offset and
+// limit have been applied, and the position following the last one.
+func (b *MemoryBackend) query(q *QuerySpec) ([]*memoryEntity, int, error) {
+	start, err := memoryCursorPosition(q.Start)
+	if err != nil {
+		return nil, 0, err
+	}
+	filters := make([]Filter, len(q.Filters))
+	for i, f := range q.Filters {
+		if filters[i], err = normalizeFilter(f); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	b.mu.Lock()
+	var matches []*memoryEntity
+	for _, e := range b.entities {
+		if e.key.Namespace != q.Namespace || (q.Kind != "" && e.key.Kind != q.Kind) {
+			continue
+		}
+		if q.Ancestor != nil && !hasAncestor(e.key, q.Ancestor) {
+			continue
+		}
+		if memoryMatches(e, filters, q.Orders) {
+			matches = append(matches, &memoryEntity{key: e.key, props: e.props})
+		}
+	}
+	b.mu.Unlock()
+
+	sort.Slice(matches, func(i, j int) bool {
+		for _, o := range q.Orders {
+			c := compareValues(orderValue(matches[i], o), orderValue(matches[j], o))
+			if o.Desc {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return compareKeys(matches[i].key, matches[j].key) < 0
+	})
+
+	begin := start + q.Offset
+	if begin > len(matches) {
+		begin = len(matches)
+	}
+	end := len(matches)
+	if q.Limit >= 0 && begin+q.Limit < end {
+		end = begin + q.Limit
+	}
+	return matches[begin:end], end, nil
+}
+
+// hasAncestor reports whether ancestor is key or one of its ancestors.
+func hasAncestor(key, ancestor *datastore.Key) bool {
+	as := keyString(ancestor)
+	for k := key; k != nil; k = k.Parent {
+		if keyString(k) == as {
+			return true
+		}
+	}
+	return false
+}
+
+// indexedValues returns the indexed values of a property, flattening lists.
+func indexedValues(e *memoryEntity, field string) []interface{} {
+	if field == "__key__" {
+		return []interface{}{e.key}
+	}
+	var values []interface{}
+	for _, p := range e.props {
+		if p.Name != field || p.NoIndex {
+			continue
+		}
+		if list, ok := p.Value.([]interface{}); ok {
+			for _, v := range list {
+				values = append(values, normalizeValue(v))
+			}
+		} else {
+			values = append(values, normalizeValue(p.Value))
+		}
+	}
+	return values
+}
+
+// orderValue returns the value an entity is sorted by for o: the smallest
+// value of the property in ascending order, the largest in descending order.
+func orderValue(e *memoryEntity, o Order) interface{} {
+	values := indexedValues(e, o.Field)
+	v := values[0]
+	for _, x := range values[1:] {
+		if c := compareValues(x, v); (c < 0 && !o.Desc) || (c > 0 && o.Desc) {
+			v = x
+		}
+	}
+	return v
+}
+
+// memoryMatches reports whether an entity matches all filters and has the properties to be sorted by.
+func memoryMatches(e *memoryEntity, filters []Filter, orders []Order) bool {
+	for _, o := range orders {
+		if len(indexedValues(e, o.Field)) == 0 {
+			return false
+		}
+	}
+	for _, f := range filters {
+		if !filterMatches(indexedValues(e, f.Field), f) {
+			return false
+		}
+	}
+	return true
+}
+
+// filterMatches reports whether any of the values of a property matches f.
+func filterMatches(values []interface{}, f Filter) bool {
+	if f.Op == "not-in" {
+		if len(values) == 0 {
+			return false
+		}
+		for _, v := range values {
+			for _, x := range f.Value.([]interface{}) {
+				if compareValues(v, x) == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	for _, v := range values {
+		if f.Op == "in" {
+			for _, x := range f.Value.([]interface{}) {
+				if compareValues(v, x) == 0 {
+					return true
+				}
+			}
+			continue
+		}
+		c := compareValues(v, f.Value)
+		switch f.Op {
+		case "=":
+			if c == 0 {
+				return true
+			}
+		case "!=":
+			if c != 0 {
+				return true
+			}
+		case "<":
+			if c < 0 {
+				return true
+			}
+		case "<=":
+			if c <= 0 {
+				return true
+			}
+		case ">":
+			if c > 0 {
+				return true
+			}
+		case ">=":
+			if c >= 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// normalizeFilter validates the operator of a filter and normalizes its value.
+func normalizeFilter(f Filter) (Filter, error) {
+	switch f.Op {
+	case "=", "!=", "<", "<=", ">", ">=":
+		f.Value = normalizeValue(f.Value)
+	case "in", "not-in":
+		v := reflect.ValueOf(f.Value)
+		if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+			return f, fmt.Errorf("datastore: %s filter requires a slice value, got %T", f.Op, f.Value)
+		}
+		values := make([]interface{}, v.Len())
+		for i := range values {
+			values[i] = normalizeValue(v.Index(i).Interface())
+		}
+		f.Value = values
+	default:
+		return f, fmt.Errorf("datastore: invalid operator %q in filter", f.Op)
+	}
+	return f, nil
+}
+
+// normalizeValue converts a value to the type Datastore stores it as.
+func normalizeValue(v interface{}) interface{} {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if _, ok := v.(time.Duration); !ok {
+			return rv.Int()
+		}
+		return int64(v.(time.Duration))
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.String:
+		return rv.String()
+	case reflect.Bool:
+		return rv.Bool()
+	}
+	if t, ok := v.(time.Time); ok {
+		return t.Truncate(time.Microsecond)
+	}
+	return v
+}
+
+// valueRank is the rank of the type of a value in the Datastore sort order.
+func valueRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case int64, time.Time:
+		return 1
+	case bool:
+		return 2
+	case string, []byte:
+		return 3
+	case float64:
+		return 4
+	case datastore.GeoPoint:
+		return 5
+	case *datastore.Key:
+		return 6
+	default:
+		return 7
+	}
+}
+
+// compareValues compares two normalized values, following the Datastore sort order.
+func compareValues(a, b interface{}) int {
+	ra, rb := valueRank(a), valueRank(b)
+	if ra != rb {
+		return ra - rb
+	}
+	switch a := a.(type) {
+	case int64:
+		if b, ok := b.(int64); ok {
+			return compareOrdered(a, b)
+		}
+		// integers sort before timestamps
+		return -1
+	case time.Time:
+		if b, ok := b.(time.Time); ok {
+			return a.Compare(b)
+		}
+		return 1
+	case bool:
+		b := b.(bool)
+		if a == b {
+			return 0
+		} else if !a {
+			return -1
+		}
+		return 1
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b)
+		}
+		return bytes.Compare([]byte(a), b.([]byte))
+	case []byte:
+		if b, ok := b.(string); ok {
+			return bytes.Compare(a, []byte(b))
+		}
+		return bytes.Compare(a, b.([]byte))
+	case float64:
+		return compareOrdered(a, b.(float64))
+	case datastore.GeoPoint:
+		b := b.(datastore.GeoPoint)
+		if c := compareOrdered(a.Lat, b.Lat); c != 0 {
+			return c
+		}
+		return compareOrdered(a.Lng, b.Lng)
+	case *datastore.Key:
+		return compareKeys(a, b.(*datastore.Key))
+	}
+	return 0
+}
+
+// compareOrdered compares two integers or floats.
+func compareOrdered[V int64 | float64](a, b V) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+// compareKeys compares two keys, following the Datastore sort order.
+func compareKeys(a, b *datastore.Key) int {
+	if a == nil || b == nil {
+		switch {
+		case a == b:
+			return 0
+		case a == nil:
+			return -1
+		default:
+			return 1
+		}
+	}
+	var pa, pb []*datastore.Key
+	for k := a; k != nil; k = k.Parent {
+		pa = append([]*datastore.Key{k}, pa...)
+	}
+	for k := b; k != nil; k = k.Parent {
+		pb = append([]*datastore.Key{k}, pb...)
+	}
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		x, y := pa[i], pb[i]
+		if c := strings.Compare(x.Kind, y.Kind); c != 0 {
+			return c
+		}
+		switch {
+		case x.Name == "" && y.Name == "":
+			if c := compareOrdered(x.ID, y.ID); c != 0 {
+				return c
+			}
+		case x.Name == "":
+			// IDs sort before names
+			return -1
+		case y.Name == "":
+			return 1
+		default:
+			if c := strings.Compare(x.Name, y.Name); c != 0 {
+				return c
+			}
+		}
+	}
+	return len(pa) - len(pb)
+}
+
+// memoryTx is the Tx of a MemoryBackend.
+type memoryTx struct {
+	b   *MemoryBackend
+	ctx context.Context
+
+	mu sync.Mutex
+	// reads records the version of every key read by the transaction.
+	reads map[string]int64
+	muts  []*memoryMutation
+}
+
+// read records that the transaction read key at version.
+func (t *memoryTx) read(key *datastore.Key, version int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.reads[keyString(key)] = version
+}
+
+func (t *memoryTx) Context() context.Context {
+	return t.ctx
+}
+
+func (t *memoryTx) Get(key *datastore.Key, dst interface{}) error {
+	if err := t.ctx.Err(); err != nil {
+		return err
+	}
+	version, err := t.b.get(key, dst)
+	if err == nil || err == datastore.ErrNoSuchEntity {
+		t.read(key, version)
+	}
+	return err
+}
+
+func (t *memoryTx) GetMulti(keys []*datastore.Key, dst interface{}) error {
+	if err := t.ctx.Err(); err != nil {
+		return err
+	}
+	versions, err := t.b.getMulti(keys, dst)
+	merr, _ := err.(datastore.MultiError)
+	for i, version := range versions {
+		if merr == nil || merr[i] == nil || merr[i] == datastore.ErrNoSuchEntity {
+			t.read(keys[i], version)
+		}
+	}
+	return err
+}
+
+func (t *memoryTx) Mutate(muts ...*Mutation) ([]*PendingKey, error) {
+	staged, err := t.b.stage(muts)
+	if err != nil {
+		return nil, err
+	}
+	pks := make([]*PendingKey, len(staged))
+	for i, m := range staged {
+		m.pending = &memoryPendingKey{}
+		pks[i] = NewPendingKey(m.pending)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.muts = append(t.muts, staged...)
+	return pks, nil
+}
+
+func (t *memoryTx) GetAll(q *QuerySpec, dst interface{}) ([]*datastore.Key, error) {
+	if err := t.ctx.Err(); err != nil {
+		return nil, err
+	}
+	results, _, err := t.b.query(q)
+	if err != nil {
+		return nil, err
+	}
+	t.b.mu.Lock()
+	versions := make([]int64, len(results))
+	for i, e := range results {
+		versions[i] = t.b.versions[keyString(e.key)]
+	}
+	t.b.mu.Unlock()
+	for i, e := range results {
+		t.read(e.key, versions[i])
+	}
+	return loadMemoryResults(results, q.KeysOnly, dst)
+}
+
+// memoryCommit is the Commit of a MemoryBackend transaction.
+type memoryCommit struct{}
+
+func (memoryCommit) Key(pk *PendingKey) *datastore.Key {
+	if p, ok := pk.Ref().(*memoryPendingKey); ok {
+		return copyKey(p.key)
+	}
+	return nil
+}
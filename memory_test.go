@@ -0,0 +1,225 @@
+package dsent
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var _ Backend = (*MemoryBackend)(nil)
+
+type memoryObj struct {
+	Parent *datastore.Key `datastore:"-"`
+	ID     int64          `datastore:"-"`
+	Name   string         `datastore:"name"`
+	Tags   []string       `datastore:"tags"`
+	Score  int            `datastore:"score"`
+	Secret string         `datastore:"secret,noindex"`
+}
+
+func (x *memoryObj) BuildKey(ns string) (*datastore.Key, error) {
+	return SetNS(datastore.IDKey("Memory", x.ID, x.Parent), ns), nil
+}
+
+func (x *memoryObj) LoadKey(k *datastore.Key) error {
+	x.ID = k.ID
+	x.Parent = k.Parent
+	return nil
+}
+
+func (x *memoryObj) Load(ps []datastore.Property) error {
+	return datastore.LoadStruct(x, ps)
+}
+
+func (x *memoryObj) Save() ([]datastore.Property, error) {
+	return datastore.SaveStruct(x)
+}
+
+// newMemoryDSEnt creates a DSEnt of the given kind running against a new
+// MemoryBackend, with its own registry.
+func newMemoryDSEnt[T Object](t testing.TB, kind string, opts ...Option) *DSEnt[T] {
+	t.Helper()
+	return newDSEnt[T](t, NewMemoryBackend(), kind, opts...)
+}
+
+// newDSEnt creates a DSEnt of the given kind running against backend, with its own registry.
+func newDSEnt[T Object](t testing.TB, backend Backend, kind string, opts ...Option) *DSEnt[T] {
+	t.Helper()
+	db, err := TryNewDSEntWithBackend[T](backend, "", kind, append([]Option{WithRegistry(NewRegistry())}, opts...)...)
+	require.NoError(t, err)
+	t.Cleanup(db.Close)
+	return db
+}
+
+func TestMemoryBackendCRUD(t *testing.T) {
+	ctx := context.Background()
+	db := NewDSEntWithBackend[*memoryObj](NewMemoryBackend(), "ns", "Memory", WithRegistry(NewRegistry()))
+
+	_, _, err := db.Create(ctx, &memoryObj{ID: 1, Name: "a"})
+	require.NoError(t, err)
+	_, _, err = db.Create(ctx, &memoryObj{ID: 1, Name: "b"})
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	key, obj, err := db.Create(ctx, &memoryObj{Name: "auto"})
+	require.NoError(t, err)
+	require.NotZero(t, key.ID)
+	require.Equal(t, key.ID, obj.ID)
+
+	_, err = db.Update(ctx, &memoryObj{ID: 100}, func(x *memoryObj) (*memoryObj, error) { return x, nil }, nil)
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = db.Backend().Mutate(ctx, NewUpdate(datastore.IDKey("Memory", 100, nil), &memoryObj{}))
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, _, err = db.Put(ctx, &memoryObj{ID: 1, Name: "c"})
+	require.NoError(t, err)
+	got, err := db.Get(ctx, &memoryObj{ID: 1})
+	require.NoError(t, err)
+	require.Equal(t, "c", got.Name)
+
+	// entities are isolated by namespace
+	other := NewDSEntWithBackend[*memoryObj](db.Backend(), "other", "Memory", WithRegistry(NewRegistry()))
+	_, err = other.Get(ctx, &memoryObj{ID: 1})
+	require.ErrorIs(t, err, ErrNotFound)
+
+	objs, err := db.BatchGet(ctx, []*memoryObj{{ID: 1}, {ID: 3}})
+	berr, ok := err.(*BatchError[*memoryObj])
+	require.True(t, ok)
+	require.NoError(t, berr.Errs[0])
+	require.ErrorIs(t, berr.Errs[1], ErrNotFound)
+	require.Equal(t, "c", objs[0].Name)
+
+	require.NoError(t, db.Delete(ctx, &memoryObj{ID: 1}))
+	require.NoError(t, db.Delete(ctx, &memoryObj{ID: 1}))
+	ok, err = db.Exists(ctx, &memoryObj{ID: 1})
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestMemoryBackendQuery(t *testing.T) {
+	ctx := context.Background()
+	db := NewDSEntWithBackend[*memoryObj](NewMemoryBackend(), "", "Memory", WithRegistry(NewRegistry()))
+	parent := datastore.NameKey("Parent", "p", nil)
+	_, _, err := db.BatchCreate(ctx, []*memoryObj{
+		{ID: 1, Name: "a", Tags: []string{"x", "y"}, Score: 3, Secret: "s"},
+		{ID: 2, Name: "b", Tags: []string{"y"}, Score: 1},
+		{ID: 3, Name: "c", Score: 2, Parent: parent},
+		{ID: 4, Name: "d", Score: 2},
+	})
+	require.NoError(t, err)
+
+	ids := func(objs []*memoryObj, err error) []int64 {
+		require.NoError(t, err)
+		var ids []int64
+		for _, obj := range objs {
+			ids = append(ids, obj.ID)
+		}
+		return ids
+	}
+
+	// ties are sorted by key
+	require.Equal(t, []int64{2, 4, 3, 1}, ids(db.Query().Order("score").All(ctx)))
+	require.Equal(t, []int64{1, 4, 3, 2}, ids(db.Query().Order("-score").Order("-name").All(ctx)))
+	require.Equal(t, []int64{1, 2}, ids(db.Query().Filter("tags", "=", "y").All(ctx)))
+	require.Equal(t, []int64{3, 4}, ids(db.Query().Filter("score", "=", 2).Order("name").All(ctx)))
+	require.Equal(t, []int64{1, 3}, ids(db.Query().Filter("name", "in", []string{"a", "c"}).Order("name").All(ctx)))
+	require.Equal(t, []int64{2, 4}, ids(db.Query().Filter("name", "not-in", []string{"a", "c"}).Order("name").All(ctx)))
+	require.Equal(t, []int64{3}, ids(db.Query().Ancestor(parent).All(ctx)))
+	// the ancestor of the caller is left untouched
+	ancestor := datastore.NameKey("Parent", "p", nil)
+	ancestor.Namespace = "caller"
+	require.Equal(t, []int64{3}, ids(db.Query().Ancestor(ancestor).All(ctx)))
+	require.Equal(t, "caller", ancestor.Namespace)
+	require.Equal(t, []int64{4}, ids(db.Query().Filter("__key__", "=", datastore.IDKey("Memory", 4, nil)).All(ctx)))
+	// noindex properties cannot be queried
+	require.Empty(t, ids(db.Query().Filter("secret", "=", "s").All(ctx)))
+
+	n, err := db.Query().Filter("score", ">=", 2).Count(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+
+	q := db.Query().Order("name")
+	spec := q.Spec()
+	spec.Limit = 2
+	_, c, err := db.Backend().Run(ctx, spec, nil)
+	require.NoError(t, err)
+	spec.Start = c
+	keys, _, err := db.Backend().Run(ctx, spec, nil)
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	require.Equal(t, int64(3), keys[0].ID)
+	require.Equal(t, []int64{2, 3}, ids(q.Offset(1).Limit(2).All(ctx)))
+}
+
+func TestMemoryBackendTransaction(t *testing.T) {
+	ctx := context.Background()
+	db := NewDSEntWithBackend[*memoryObj](NewMemoryBackend(), "", "Memory", WithRegistry(NewRegistry()))
+	require.Nil(t, db.Client())
+
+	// writes are applied on commit and pending keys are resolved
+	var pk *PendingKey
+	cmt, err := db.RunInTransaction(ctx, func(tx Tx) error {
+		var err error
+		pk, _, err = db.CreateTx(tx, &memoryObj{Name: "auto"})
+		return err
+	})
+	require.NoError(t, err)
+	key := cmt.Key(pk)
+	require.NotNil(t, key)
+	_, err = db.Get(ctx, &memoryObj{ID: key.ID})
+	require.NoError(t, err)
+
+	// a failed transaction applies nothing
+	_, _, err = db.BatchCreate(ctx, []*memoryObj{{ID: 10}, {ID: key.ID}})
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+	_, err = db.Get(ctx, &memoryObj{ID: 10})
+	require.ErrorIs(t, err, ErrNotFound)
+
+	// a transaction whose reads were written concurrently is retried
+	attempts := 0
+	_, err = db.RunInTransaction(ctx, func(tx Tx) error {
+		attempts++
+		obj, err := db.GetTx(tx, &memoryObj{ID: key.ID})
+		if err != nil {
+			return err
+		}
+		if attempts == 1 {
+			_, _, err := db.Put(ctx, &memoryObj{ID: key.ID, Name: "concurrent"})
+			require.NoError(t, err)
+		}
+		obj.Score++
+		_, _, err = db.PutTx(tx, obj)
+		return err
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, attempts)
+	got, err := db.Get(ctx, &memoryObj{ID: key.ID})
+	require.NoError(t, err)
+	require.Equal(t, "concurrent", got.Name)
+	require.Equal(t, 1, got.Score)
+
+	// it fails after too many conflicts
+	_, err = db.RunInTransaction(ctx, func(tx Tx) error {
+		if _, err := db.GetTx(tx, &memoryObj{ID: key.ID}); err != nil {
+			return err
+		}
+		_, _, err := db.Put(ctx, &memoryObj{ID: key.ID})
+		return err
+	})
+	require.ErrorIs(t, err, ErrConcurrentTransaction)
+
+	// ExistsTx does not query once its context is done
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = db.RunInTransaction(ctx, func(tx Tx) error {
+		ok, err := db.ExistsTx(ctx, tx, &memoryObj{ID: key.ID})
+		require.NoError(t, err)
+		require.True(t, ok)
+		_, err = db.ExistsTx(canceled, tx, &memoryObj{ID: key.ID})
+		return err
+	})
+	require.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,193 @@
+package dsent
+
+import (
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Option configures optional behavior of a DSEnt.
+type Option func(*options)
+
+// options holds the optional settings of a DSEnt.
+type options struct {
+	cursorKey     string
+	legacyCursors bool
+	legacyUntil   time.Time
+	cursorCodec   TokenCodec
+	cursorTTL     time.Duration
+	now           func() time.Time
+	registry      *Registry
+	// softDeleteProperty is the property of the deleted-at time of soft-deleted entities.
+	softDeleteProperty string
+	// auditKind is the kind of the audit entities.
+	auditKind string
+	// txOptions are the default options of the transactions of the DSEnt.
+	txOptions []TxOption
+	cache     Cache
+	coalesce  bool
+	// negativeCache holds the keys of the entities known not to exist.
+	negativeCache Cache
+	// tracerProvider provides the tracer of the spans of the operations of the DSEnt.
+	tracerProvider trace.TracerProvider
+}
+
+// acceptLegacyCursors reports whether page tokens of previous versions are still accepted.
+func (o *options) acceptLegacyCursors() bool {
+	return o.legacyCursors && (o.legacyUntil.IsZero() || !o.now().After(o.legacyUntil))
+}
+
+// WithCursorKey sets the secret used to encrypt the page tokens returned by Page.
+func WithCursorKey(key string) Option {
+	return func(o *options) {
+		o.cursorKey = key
+	}
+}
+
+// WithLegacyCursors makes Page accept page tokens encrypted with EncryptMessage
+// by previous versions until the given time, to let clients migrate.
+// A zero time accepts them forever.
+func WithLegacyCursors(until time.Time) Option {
+	return func(o *options) {
+		o.legacyCursors = true
+		o.legacyUntil = until
+	}
+}
+
+// WithCursorCodec sets the codec used to encrypt the page tokens returned by Page,
+// e.g. a Keyring to be able to rotate secrets. It takes precedence over WithCursorKey.
+func WithCursorCodec(codec TokenCodec) Option {
+	return func(o *options) {
+		o.cursorCodec = codec
+	}
+}
+
+// WithCursorTTL makes the page tokens returned by Page expire after ttl.
+func WithCursorTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.cursorTTL = ttl
+	}
+}
+
+// WithRegistry sets the registry the kind of the DSEnt is registered in and
+// validated against, instead of the DefaultRegistry.
+func WithRegistry(r *Registry) Option {
+	return func(o *options) {
+		o.registry = r
+	}
+}
+
+// WithClock sets the clock of the DSEnt, time.Now by default. It is used for
+// the timestamps of Timestamped objects and the expiry of page tokens.
+func WithClock(now func() time.Time) Option {
+	return func(o *options) {
+		o.now = now
+	}
+}
+
+// WithSoftDelete makes the DSEnt soft delete its entities: Delete and the other
+// delete methods set the deleted-at time of the objects, stored as the given
+// property, instead of removing them. T must implement SoftDeletable.
+//
+// Get, BatchGet, Exists and Update treat soft-deleted entities as not found,
+// Create and the other create methods replace them, within a transaction, and
+// Query and NewQuery exclude them unless Query.WithDeleted is used. Note that
+// Datastore queries then need composite indexes including the property.
+// Use Restore to restore soft-deleted entities and Purge to remove them.
+// Soft deletes and restores are written like updates of the stored entities,
+// running the BeforeSave hooks and validation and setting the UpdatedAt time.
+//
+// Queries match the entities whose property is the zero time, as Datastore
+// cannot query for missing properties. Entities written before enabling soft
+// delete lack the property: Get and Exists return them, but queries skip them
+// until they are backfilled, e.g. by reading them with Query.WithDeleted and
+// writing them again with BulkPut, which stores the zero time.
+func WithSoftDelete(property string) Option {
+	return func(o *options) {
+		o.softDeleteProperty = property
+	}
+}
+
+// WithAudit makes the DSEnt record every write of its entities with an
+// AuditEntry of the given kind, in the same namespace. The entry is written in
+// the same transaction as the entity: Create, Put and Delete then run in a
+// transaction, and every chunk of the Bulk* methods in its own transaction.
+// Use History to get the entries of an entity.
+//
+// As every write also writes an audit entity, a transaction can only write
+// half as many entities, and the chunks of the Bulk* methods are halved too.
+// The IDs of the entities created with an incomplete key are allocated with
+// Backend.AllocateIDs when their write is staged, so that their entries record
+// their complete key.
+func WithAudit(kind string) Option {
+	return func(o *options) {
+		o.auditKind = kind
+	}
+}
+
+// WithTxOptions sets the default options of the transactions run by the DSEnt,
+// by RunInTransaction, Transact, and the methods that write within a transaction
+// such as Update and BatchCreate.
+func WithTxOptions(opts ...TxOption) Option {
+	return func(o *options) {
+		o.txOptions = append(o.txOptions, opts...)
+	}
+}
+
+// WithCache makes Get, BatchGet and BulkGet read entities through cache: they
+// are read from the cache if they are in it, and added to it when they are read
+// from Datastore. Reads within transactions and queries bypass the cache.
+//
+// The entities are removed from the cache when they are written or deleted
+// through the DSEnt, once the transaction commits for writes within a
+// transaction. Transactions not started by the DSEnt, e.g. wrapped with
+// NewClientTx, invalidate the cache when they are staged instead. Writes made
+// by other processes are only seen once cached entries expire, and so can a
+// read racing with a write, so use a short TTL.
+func WithCache(cache Cache) Option {
+	return func(o *options) {
+		o.cache = cache
+	}
+}
+
+// WithCoalescing makes concurrent Get, BatchGet and BulkGet calls of the DSEnt
+// share the reads of the entities they look up at the same time: an entity is
+// read by the first call, and the others wait for its result. Every call loads
+// its own copy of the entity. With WithCache, only cache misses are read.
+func WithCoalescing() Option {
+	return func(o *options) {
+		o.coalesce = true
+	}
+}
+
+// WithNegativeCache makes Get, BatchGet, BulkGet and Exists remember the
+// entities they did not find in cache, e.g. a LRUCache with a short TTL, and
+// report them as not found without reading Datastore while they are in it.
+//
+// The entities are removed from it when they are written through the DSEnt,
+// as with WithCache, including the entities created with incomplete keys.
+// Entities created by other processes are only seen once the entries expire.
+func WithNegativeCache(cache Cache) Option {
+	return func(o *options) {
+		o.negativeCache = cache
+	}
+}
+
+// WithTracerProvider makes the DSEnt start a span with a tracer of tp for
+// every operation: the reads and writes, their batch and Tx variants, queries,
+// Page, History and transactions, including UnitOfWork.Commit. Spans are named after the operation, e.g.
+// "dsent.BatchGet", and have the attributes:
+//
+//   - dsent.kind and dsent.namespace, of the DSEnt;
+//   - dsent.operation, the name of the method;
+//   - dsent.batch_size, the number of objects, or of results for queries;
+//   - dsent.tx.attempt, the attempt of the transaction run by the operation,
+//     or of the ManagedTx of the Tx methods;
+//   - dsent.error_code, the gRPC code of the error, e.g. NotFound or Aborted.
+//
+// By default the DSEnt does not trace its operations.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(o *options) {
+		o.tracerProvider = tp
+	}
+}
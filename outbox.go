@@ -0,0 +1,327 @@
+package dsent
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// ErrInvalidInterval is returned by Outbox.Run when the interval is not positive.
+var ErrInvalidInterval = errors.New("interval must be positive")
+
+// OutboxStatus is the delivery status of an OutboxMessage.
+type OutboxStatus string
+
+const (
+	// OutboxPending messages are waiting to be delivered, or retried.
+	OutboxPending OutboxStatus = "pending"
+	// OutboxDone messages have been delivered.
+	OutboxDone OutboxStatus = "done"
+	// OutboxFailed messages could not be delivered within the maximum number of attempts.
+	OutboxFailed OutboxStatus = "failed"
+)
+
+// OutboxMessage is a message stored in an Outbox.
+type OutboxMessage struct {
+	// ID is the ID of the outbox entity.
+	ID        int64        `datastore:"-"`
+	Topic     string       `datastore:"topic"`
+	Payload   []byte       `datastore:"payload,noindex"`
+	Status    OutboxStatus `datastore:"status"`
+	CreatedAt time.Time    `datastore:"created_at"`
+	// Attempts is the number of delivery attempts, including the current one
+	// when the message is given to a Publisher.
+	Attempts int `datastore:"attempts,noindex"`
+	// NextAttempt is the time the message is due for delivery. It is only
+	// stored while the message is pending.
+	NextAttempt time.Time `datastore:"next_attempt"`
+	DoneAt      time.Time `datastore:"done_at,noindex"`
+	// LastError is the error of the last failed delivery attempt.
+	LastError string `datastore:"last_error,noindex"`
+}
+
+func (m *OutboxMessage) LoadKey(k *datastore.Key) error {
+	m.ID = k.ID
+	return nil
+}
+
+func (m *OutboxMessage) Load(ps []datastore.Property) error {
+	return datastore.LoadStruct(m, ps)
+}
+
+func (m *OutboxMessage) Save() ([]datastore.Property, error) {
+	ps, err := datastore.SaveStruct(m)
+	if err != nil || m.Status == OutboxPending {
+		return ps, err
+	}
+	// only pending messages match the query of the dispatcher
+	for i, p := range ps {
+		if p.Name == "next_attempt" {
+			return append(ps[:i], ps[i+1:]...), nil
+		}
+	}
+	return ps, nil
+}
+
+// Publisher delivers the messages of an Outbox, e.g. to a message broker.
+// A message may be delivered more than once, so Publish should be idempotent.
+type Publisher interface {
+	Publish(ctx context.Context, msg *OutboxMessage) error
+}
+
+// PublisherFunc adapts a function to a Publisher.
+type PublisherFunc func(ctx context.Context, msg *OutboxMessage) error
+
+func (f PublisherFunc) Publish(ctx context.Context, msg *OutboxMessage) error {
+	return f(ctx, msg)
+}
+
+// outboxOptions holds the optional settings of an Outbox.
+type outboxOptions struct {
+	batchSize   int
+	maxAttempts int
+	lease       time.Duration
+	backoff     func(attempt int) time.Duration
+	now         func() time.Time
+}
+
+// OutboxOption configures optional behavior of an Outbox.
+type OutboxOption func(*outboxOptions)
+
+// WithOutboxBatchSize sets the maximum number of messages delivered by a
+// single Dispatch, 100 by default.
+func WithOutboxBatchSize(n int) OutboxOption {
+	return func(o *outboxOptions) {
+		o.batchSize = n
+	}
+}
+
+// WithOutboxMaxAttempts sets the number of delivery attempts after which a
+// message is marked as failed, 10 by default.
+func WithOutboxMaxAttempts(n int) OutboxOption {
+	return func(o *outboxOptions) {
+		o.maxAttempts = n
+	}
+}
+
+// WithOutboxLease sets how long a message being delivered is hidden from the
+// other dispatchers, 1 minute by default. It should be longer than Publish takes.
+func WithOutboxLease(lease time.Duration) OutboxOption {
+	return func(o *outboxOptions) {
+		o.lease = lease
+	}
+}
+
+// WithOutboxBackoff sets the delay before retrying a message after its given
+// failed attempt, starting at 1. By default it doubles from 1 second up to 1 hour.
+func WithOutboxBackoff(backoff func(attempt int) time.Duration) OutboxOption {
+	return func(o *outboxOptions) {
+		o.backoff = backoff
+	}
+}
+
+// WithOutboxClock sets the clock of the Outbox, time.Now by default.
+func WithOutboxClock(now func() time.Time) OutboxOption {
+	return func(o *outboxOptions) {
+		o.now = now
+	}
+}
+
+// defaultOutboxBackoff doubles the delay from 1 second up to 1 hour.
+var defaultOutboxBackoff = exponentialBackoff(time.Second, time.Hour)
+
+// Outbox stores messages as entities written within the transactions of the
+// changes they describe, so that a message is published if and only if its
+// transaction commits. Messages are enqueued with EnqueueTx and delivered by
+// Dispatch or Run, at least once, with retries.
+//
+// Pending messages are queried on their due time only, so no composite index
+// is needed.
+type Outbox struct {
+	backend   Backend
+	namespace string
+	kind      string
+	opts      outboxOptions
+}
+
+// NewOutbox creates an Outbox storing its messages as entities of the given
+// kind and namespace of backend.
+func NewOutbox(backend Backend, namespace, kind string, opts ...OutboxOption) *Outbox {
+	o := outboxOptions{
+		batchSize:   100,
+		maxAttempts: 10,
+		lease:       time.Minute,
+		backoff:     defaultOutboxBackoff,
+		now:         time.Now,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &Outbox{backend: backend, namespace: namespace, kind: kind, opts: o}
+}
+
+// now returns the current time, at the precision of Datastore.
+func (o *Outbox) now() time.Time {
+	return o.opts.now().Truncate(time.Microsecond)
+}
+
+// EnqueueTx stores a message within tx, to be delivered once tx commits.
+// The key of the message can be resolved with the Commit of the transaction.
+func (o *Outbox) EnqueueTx(tx Tx, topic string, payload []byte) (*PendingKey, error) {
+	now := o.now()
+	msg := &OutboxMessage{
+		Topic:       topic,
+		Payload:     payload,
+		Status:      OutboxPending,
+		CreatedAt:   now,
+		NextAttempt: now,
+	}
+	key := datastore.IncompleteKey(o.kind, nil)
+	key.Namespace = o.namespace
+	pks, err := tx.Mutate(NewInsert(key, msg))
+	if err != nil {
+		return nil, err
+	}
+	return pks[0], nil
+}
+
+// Get returns the message of the given ID.
+func (o *Outbox) Get(ctx context.Context, id int64) (*OutboxMessage, error) {
+	msg := &OutboxMessage{}
+	if err := o.backend.Get(ctx, o.key(id), msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// key returns the key of the message of the given ID.
+func (o *Outbox) key(id int64) *datastore.Key {
+	return SetNS(datastore.IDKey(o.kind, id, nil), o.namespace)
+}
+
+// Dispatch delivers the pending messages that are due, oldest first, up to the
+// batch size, and returns the number of messages delivered.
+//
+// Every message is claimed within a transaction before it is given to pub, so
+// that concurrent dispatchers do not deliver it at the same time. A delivered
+// message is marked as done; otherwise its error is recorded and it is retried
+// after a backoff, or marked as failed after the maximum number of attempts.
+// The result is not recorded if the lease of the claim expired and the message
+// was claimed again meanwhile. Errors of pub are not returned.
+func (o *Outbox) Dispatch(ctx context.Context, pub Publisher) (int, error) {
+	keys, err := o.backend.GetAll(ctx, &QuerySpec{
+		Kind:      o.kind,
+		Namespace: o.namespace,
+		Filters:   []Filter{{Field: "next_attempt", Op: "<=", Value: o.now()}},
+		Orders:    []Order{{Field: "next_attempt"}},
+		Limit:     o.opts.batchSize,
+		KeysOnly:  true,
+	}, nil)
+	if err != nil {
+		return 0, err
+	}
+	delivered := 0
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return delivered, err
+		}
+		ok, err := o.deliver(ctx, pub, key)
+		if err != nil {
+			return delivered, err
+		}
+		if ok {
+			delivered++
+		}
+	}
+	return delivered, nil
+}
+
+// deliver claims the message of key, gives it to pub and records the result,
+// unless the message was claimed again meanwhile. It reports whether the
+// message was delivered.
+func (o *Outbox) deliver(ctx context.Context, pub Publisher, key *datastore.Key) (bool, error) {
+	msg := &OutboxMessage{}
+	claimed := false
+	_, err := o.backend.RunInTransaction(ctx, func(tx Tx) error {
+		*msg = OutboxMessage{}
+		claimed = false
+		if err := tx.Get(key, msg); err != nil {
+			return err
+		}
+		now := o.now()
+		if msg.Status != OutboxPending || msg.NextAttempt.After(now) {
+			// delivered or claimed by another dispatcher
+			return nil
+		}
+		msg.Attempts++
+		msg.NextAttempt = now.Add(o.opts.lease)
+		claimed = true
+		_, err := tx.Mutate(NewUpdate(key, msg))
+		return err
+	})
+	if err == datastore.ErrNoSuchEntity || (err == nil && !claimed) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	claim := *msg
+	delivery := claim
+	perr := pub.Publish(ctx, &delivery)
+	_, err = o.backend.RunInTransaction(ctx, func(tx Tx) error {
+		*msg = OutboxMessage{}
+		if err := tx.Get(key, msg); err != nil {
+			return err
+		}
+		if msg.Status != OutboxPending || msg.Attempts != claim.Attempts || !msg.NextAttempt.Equal(claim.NextAttempt) {
+			// the lease expired and another dispatcher claimed the message
+			return nil
+		}
+		now := o.now()
+		switch {
+		case perr == nil:
+			msg.Status = OutboxDone
+			msg.DoneAt = now
+			msg.LastError = ""
+		case msg.Attempts >= o.opts.maxAttempts:
+			msg.Status = OutboxFailed
+			msg.LastError = perr.Error()
+		default:
+			msg.NextAttempt = now.Add(o.opts.backoff(msg.Attempts))
+			msg.LastError = perr.Error()
+		}
+		_, err := tx.Mutate(NewUpdate(key, msg))
+		return err
+	})
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return false, err
+	}
+	return perr == nil, nil
+}
+
+// Run calls Dispatch every interval until ctx is done, or Dispatch fails.
+// Batches that are full are followed by the next one without waiting.
+// It returns ErrInvalidInterval if interval is not positive.
+func (o *Outbox) Run(ctx context.Context, pub Publisher, interval time.Duration) error {
+	if interval <= 0 {
+		return ErrInvalidInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := o.Dispatch(ctx, pub)
+		if err != nil {
+			return err
+		}
+		if n >= o.opts.batchSize {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
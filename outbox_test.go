@@ -0,0 +1,191 @@
+package dsent
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutbox(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemoryBackend()
+	db := newDSEnt[*memoryObj](t, backend, "Memory")
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	outbox := NewOutbox(backend, "", "Outbox",
+		WithOutboxMaxAttempts(2),
+		WithOutboxBackoff(func(int) time.Duration { return time.Minute }),
+		WithOutboxClock(func() time.Time { return now }),
+	)
+
+	var pk *PendingKey
+	cmt, err := db.RunInTransaction(ctx, func(tx Tx) error {
+		if _, _, err := db.PutTx(tx, &memoryObj{ID: 1, Name: "a"}); err != nil {
+			return err
+		}
+		var err error
+		pk, err = outbox.EnqueueTx(tx, "created", []byte("1"))
+		return err
+	})
+	require.NoError(t, err)
+	id := cmt.Key(pk).ID
+	// nothing is enqueued if the transaction fails
+	errAbort := errors.New("abort")
+	_, err = db.RunInTransaction(ctx, func(tx Tx) error {
+		if _, err := outbox.EnqueueTx(tx, "created", []byte("2")); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	require.ErrorIs(t, err, errAbort)
+
+	var published []*OutboxMessage
+	errPublish := errors.New("unavailable")
+	failing := true
+	pub := PublisherFunc(func(ctx context.Context, msg *OutboxMessage) error {
+		published = append(published, msg)
+		if failing {
+			return errPublish
+		}
+		return nil
+	})
+
+	n, err := outbox.Dispatch(ctx, pub)
+	require.NoError(t, err)
+	require.Zero(t, n)
+	require.Len(t, published, 1)
+	require.Equal(t, "created", published[0].Topic)
+	require.Equal(t, []byte("1"), published[0].Payload)
+	require.Equal(t, 1, published[0].Attempts)
+	msg, err := outbox.Get(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, OutboxPending, msg.Status)
+	require.Equal(t, "unavailable", msg.LastError)
+	require.Equal(t, now.Add(time.Minute), msg.NextAttempt)
+
+	// the message is not retried before its backoff
+	n, err = outbox.Dispatch(ctx, pub)
+	require.NoError(t, err)
+	require.Zero(t, n)
+	require.Len(t, published, 1)
+
+	now = now.Add(time.Minute)
+	failing = false
+	n, err = outbox.Dispatch(ctx, pub)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Len(t, published, 2)
+	msg, err = outbox.Get(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, OutboxDone, msg.Status)
+	require.Equal(t, 2, msg.Attempts)
+	require.Equal(t, now, msg.DoneAt)
+	require.Empty(t, msg.LastError)
+
+	// done messages are not delivered again
+	now = now.Add(time.Hour)
+	n, err = outbox.Dispatch(ctx, pub)
+	require.NoError(t, err)
+	require.Zero(t, n)
+	require.Len(t, published, 2)
+}
+
+func TestOutboxFailed(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemoryBackend()
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	outbox := NewOutbox(backend, "ns", "Outbox",
+		WithOutboxMaxAttempts(2),
+		WithOutboxClock(func() time.Time { return now }),
+	)
+	var pk *PendingKey
+	cmt, err := backend.RunInTransaction(ctx, func(tx Tx) error {
+		var err error
+		pk, err = outbox.EnqueueTx(tx, "created", nil)
+		return err
+	})
+	require.NoError(t, err)
+	require.Equal(t, "ns", cmt.Key(pk).Namespace)
+
+	attempts := 0
+	pub := PublisherFunc(func(ctx context.Context, msg *OutboxMessage) error {
+		attempts++
+		return errors.New("unavailable")
+	})
+	for i := 0; i < 3; i++ {
+		_, err := outbox.Dispatch(ctx, pub)
+		require.NoError(t, err)
+		now = now.Add(time.Hour)
+	}
+	require.Equal(t, 2, attempts)
+	msg, err := outbox.Get(ctx, cmt.Key(pk).ID)
+	require.NoError(t, err)
+	require.Equal(t, OutboxFailed, msg.Status)
+	require.Equal(t, "unavailable", msg.LastError)
+}
+
+func TestOutboxLease(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemoryBackend()
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	outbox := NewOutbox(backend, "", "Outbox",
+		WithOutboxLease(time.Minute),
+		WithOutboxClock(func() time.Time { return now }),
+	)
+	var pk *PendingKey
+	cmt, err := backend.RunInTransaction(ctx, func(tx Tx) error {
+		var err error
+		pk, err = outbox.EnqueueTx(tx, "created", nil)
+		return err
+	})
+	require.NoError(t, err)
+
+	// the lease expires during a slow delivery, and another dispatcher
+	// delivers the message meanwhile
+	slow := PublisherFunc(func(ctx context.Context, msg *OutboxMessage) error {
+		now = now.Add(2 * time.Minute)
+		n, err := outbox.Dispatch(ctx, PublisherFunc(func(context.Context, *OutboxMessage) error { return nil }))
+		require.NoError(t, err)
+		require.Equal(t, 1, n)
+		return errors.New("timeout")
+	})
+	_, err = outbox.Dispatch(ctx, slow)
+	require.NoError(t, err)
+	// the result of the slow delivery does not overwrite the newer one
+	msg, err := outbox.Get(ctx, cmt.Key(pk).ID)
+	require.NoError(t, err)
+	require.Equal(t, OutboxDone, msg.Status)
+	require.Equal(t, 2, msg.Attempts)
+	require.Empty(t, msg.LastError)
+}
+
+func TestOutboxRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backend := NewMemoryBackend()
+	outbox := NewOutbox(backend, "", "Outbox", WithOutboxBatchSize(1))
+	_, err := backend.RunInTransaction(ctx, func(tx Tx) error {
+		for i := 0; i < 3; i++ {
+			if _, err := outbox.EnqueueTx(tx, "created", nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	delivered := 0
+	err = outbox.Run(ctx, PublisherFunc(func(ctx context.Context, msg *OutboxMessage) error {
+		delivered++
+		if delivered == 3 {
+			cancel()
+		}
+		return nil
+	}), time.Hour)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, 3, delivered)
+
+	require.ErrorIs(t, outbox.Run(ctx, PublisherFunc(func(context.Context, *OutboxMessage) error { return nil }), 0), ErrInvalidInterval)
+}
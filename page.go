@@ -0,0 +1,199 @@
+package dsent
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+)
+
+// ErrInvalidCursor is returned when a page token is malformed, has been tampered
+// with or was issued for another kind, namespace or query.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ErrNoCursorKey is returned by Page when the DSEnt has no cursor key configured.
+var ErrNoCursorKey = errors.New("cursor key not configured")
+
+// CursorContextError is returned when a valid page token is used out of the
+// context it was issued for: with another kind, namespace or query, or after
+// it expired. It matches ErrInvalidCursor with errors.Is.
+type CursorContextError struct {
+	// Field is the mismatching part of the context: "kind", "namespace", "query" or "expiry".
+	Field string
+}
+
+func (e *CursorContextError) Error() string {
+	if e.Field == "expiry" {
+		return "cursor expired"
+	}
+	return "cursor issued for another " + e.Field
+}
+
+// Is makes CursorContextError match ErrInvalidCursor.
+func (e *CursorContextError) Is(target error) bool {
+	return target == ErrInvalidCursor
+}
+
+// cursorPayload is the message sealed in a page token.
+type cursorPayload struct {
+	Kind      string `json:"k"`
+	Namespace string `json:"ns"`
+	Query     string `json:"q"`
+	Expiry    int64  `json:"exp,omitempty"`
+	Cursor    string `json:"c"`
+}
+
+// cursorScope identifies the kind and namespace a legacy page token was issued for.
+func (db *DSEnt[T]) cursorScope() string {
+	return db.namespace + "/" + db.kind
+}
+
+// cursorMAC authenticates the scope and raw cursor of a legacy page token.
+func (db *DSEnt[T]) cursorMAC(payload string) string {
+	mac := hmac.New(sha256.New, []byte(db.opts.cursorKey))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// encodeCursor turns a Datastore cursor of query q into an opaque, encrypted page token.
+func (db *DSEnt[T]) encodeCursor(q *Query[T], c datastore.Cursor) (string, error) {
+	payload := cursorPayload{
+		Kind:      db.kind,
+		Namespace: db.namespace,
+		Query:     q.spec.fingerprint(),
+		Cursor:    c.String(),
+	}
+	if db.opts.cursorTTL > 0 {
+		payload.Expiry = db.opts.now().Add(db.opts.cursorTTL).Unix()
+	}
+	msg, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	return db.opts.cursorCodec.Encode(msg)
+}
+
+// decodeCursor verifies a page token produced by encodeCursor for query q and
+// returns its Datastore cursor.
+func (db *DSEnt[T]) decodeCursor(q *Query[T], token string) (datastore.Cursor, error) {
+	msg, legacy, err := db.opts.cursorCodec.Decode(token)
+	if err != nil {
+		return datastore.Cursor{}, err
+	}
+	var raw string
+	if len(msg) > 0 && msg[0] == '{' {
+		var payload cursorPayload
+		if err := json.Unmarshal(msg, &payload); err != nil {
+			return datastore.Cursor{}, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+		}
+		if payload.Kind != db.kind {
+			return datastore.Cursor{}, &CursorContextError{Field: "kind"}
+		} else if payload.Namespace != db.namespace {
+			return datastore.Cursor{}, &CursorContextError{Field: "namespace"}
+		} else if payload.Query != q.spec.fingerprint() {
+			return datastore.Cursor{}, &CursorContextError{Field: "query"}
+		} else if payload.Expiry != 0 && db.opts.now().Unix() > payload.Expiry {
+			return datastore.Cursor{}, &CursorContextError{Field: "expiry"}
+		}
+		raw = payload.Cursor
+	} else if raw, err = db.decodeLegacyCursor(string(msg), legacy); err != nil {
+		return datastore.Cursor{}, err
+	}
+	c, err := datastore.DecodeCursor(raw)
+	if err != nil {
+		return datastore.Cursor{}, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	return c, nil
+}
+
+// decodeLegacyCursor returns the raw cursor of a page token issued before tokens
+// were bound to queries. Such tokens are only accepted with WithLegacyCursors.
+func (db *DSEnt[T]) decodeLegacyCursor(payload string, unauthenticated bool) (string, error) {
+	if !db.opts.acceptLegacyCursors() {
+		return "", ErrInvalidCursor
+	}
+	if unauthenticated {
+		// EncryptMessage tokens are not authenticated by the codec but carry their own MAC.
+		i := strings.LastIndexByte(payload, '\n')
+		if i < 0 {
+			return "", ErrInvalidCursor
+		}
+		var sum string
+		payload, sum = payload[:i], payload[i+1:]
+		if !hmac.Equal([]byte(sum), []byte(db.cursorMAC(payload))) {
+			return "", ErrCursorAuth
+		}
+	}
+	scope, raw, ok := strings.Cut(payload, "\n")
+	if !ok {
+		return "", ErrInvalidCursor
+	} else if scope != db.cursorScope() {
+		return "", &CursorContextError{Field: "namespace"}
+	}
+	return raw, nil
+}
+
+// Page runs the query and returns at most pageSize entities starting at the
+// position encoded in token, along with the token of the next page.
+// Pass an empty token to fetch the first page. The returned token is empty
+// when there are no more results.
+//
+// Tokens are bound to the kind, namespace, filters, orders and ancestor of the
+// query; the page size may change between pages. Using a token in another
+// context returns a *CursorContextError.
+func (db *DSEnt[T]) Page(ctx context.Context, q *Query[T], pageSize int, token string) (objs []T, _ string, err error) {
+	ctx, span := db.startSpan(ctx, "Page", -1)
+	defer func() {
+		span.SetAttributes(attrBatchSize.Int(len(objs)))
+		endSpan(span, &err)
+	}()
+	if db.opts.cursorCodec == nil {
+		return nil, "", ErrNoCursorKey
+	}
+	if pageSize <= 0 {
+		return nil, "", fmt.Errorf("invalid page size: %d", pageSize)
+	}
+	if q == nil {
+		q = db.Query()
+	}
+	spec := q.spec.clone()
+	spec.Limit = pageSize
+	if token != "" {
+		c, err := db.decodeCursor(q, token)
+		if err != nil {
+			return nil, "", err
+		}
+		spec.Start = c
+	}
+
+	keys, c, err := db.backend.Run(ctx, spec, &objs)
+	if err != nil {
+		if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+			return nil, "", err
+		}
+	}
+	mismatchErr := err
+	for i, key := range keys {
+		if err := db.ResolveKey(key, objs[i]); err != nil {
+			return nil, "", err
+		}
+	}
+	if err := db.afterLoad(ctx, objs...); err != nil {
+		return nil, "", err
+	}
+	if len(objs) < pageSize {
+		return objs, "", mismatchErr
+	}
+
+	next, err := db.encodeCursor(q, c)
+	if err != nil {
+		return nil, "", err
+	}
+	return objs, next, mismatchErr
+}
@@ -0,0 +1,324 @@
+package dsent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Filter is a single property filter of a query.
+type Filter struct {
+	Field string
+	// Op is one of the operators accepted by datastore.Query.FilterField:
+	// "=", "!=", "<", "<=", ">", ">=", "in" and "not-in".
+	Op    string
+	Value interface{}
+}
+
+// Order is a single sort order of a query.
+type Order struct {
+	Field string
+	Desc  bool
+}
+
+// QuerySpec is the backend-agnostic description of a query.
+type QuerySpec struct {
+	// Kind is the kind to query, an empty kind queries all kinds.
+	Kind      string
+	Namespace string
+	Ancestor  *datastore.Key
+	Filters   []Filter
+	Orders    []Order
+	// Limit is the maximum number of results, a negative value means unlimited.
+	Limit    int
+	Offset   int
+	KeysOnly bool
+	// Start is the cursor to start the query at, the zero value starts at the beginning.
+	Start datastore.Cursor
+}
+
+// clone returns a copy of the spec that can be modified independently.
+func (s *QuerySpec) clone() *QuerySpec {
+	x := *s
+	x.Filters = append([]Filter(nil), s.Filters...)
+	x.Orders = append([]Order(nil), s.Orders...)
+	return &x
+}
+
+// datastoreQuery converts the spec into a datastore.Query.
+func (s *QuerySpec) datastoreQuery() *datastore.Query {
+	dq := datastore.NewQuery(s.Kind).Namespace(s.Namespace)
+	if s.Ancestor != nil {
+		dq = dq.Ancestor(s.Ancestor)
+	}
+	for _, f := range s.Filters {
+		dq = dq.FilterField(f.Field, f.Op, f.Value)
+	}
+	for _, o := range s.Orders {
+		if o.Desc {
+			dq = dq.Order("-" + o.Field)
+		} else {
+			dq = dq.Order(o.Field)
+		}
+	}
+	if s.Limit >= 0 {
+		dq = dq.Limit(s.Limit)
+	}
+	if s.Offset > 0 {
+		dq = dq.Offset(s.Offset)
+	}
+	if s.KeysOnly {
+		dq = dq.KeysOnly()
+	}
+	if s.Start.String() != "" {
+		dq = dq.Start(s.Start)
+	}
+	return dq
+}
+
+// fingerprint summarizes the shape of the query: its kind, namespace, ancestor,
+// filters and orders. Limit, offset, keys-only and start are not part of it.
+func (s *QuerySpec) fingerprint() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%q %q", s.Kind, s.Namespace)
+	if s.Ancestor != nil {
+		fmt.Fprintf(h, " ancestor %q", s.Ancestor.String())
+	}
+	for _, f := range s.Filters {
+		fmt.Fprintf(h, " filter %q %q %s", f.Field, f.Op, fingerprintValue(f.Value))
+	}
+	for _, o := range s.Orders {
+		fmt.Fprintf(h, " order %q %t", o.Field, o.Desc)
+	}
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:16])
+}
+
+// fingerprintValue formats a filter value for fingerprint.
+// Values are normalized to the type Datastore stores them as, so that e.g.
+// int(5) and int64(5) match, and pointers are formatted by the value they point to.
+func fingerprintValue(v interface{}) string {
+	switch v := normalizeValue(v).(type) {
+	case nil:
+		return "nil"
+	case *datastore.Key:
+		if v == nil {
+			return "key(nil)"
+		}
+		return fmt.Sprintf("key(%q)", v.String())
+	case time.Time:
+		return fmt.Sprintf("time(%s)", v.UTC().Format(time.RFC3339Nano))
+	case []byte:
+		return fmt.Sprintf("bytes(%x)", v)
+	default:
+		rv := reflect.ValueOf(v)
+		switch rv.Kind() {
+		case reflect.Slice, reflect.Array:
+			s := make([]string, rv.Len())
+			for i := range s {
+				s[i] = fingerprintValue(rv.Index(i).Interface())
+			}
+			return "[" + strings.Join(s, " ") + "]"
+		case reflect.Ptr:
+			if rv.IsNil() {
+				return "nil"
+			}
+			return fingerprintValue(rv.Elem().Interface())
+		}
+		return fmt.Sprintf("%T(%#v)", v, v)
+	}
+}
+
+// Query is a typed query over the entities of a DSEnt.
+// Like datastore.Query, it is immutable: every builder method returns a new Query.
+type Query[T Object] struct {
+	db   *DSEnt[T]
+	spec *QuerySpec
+	tx   Tx
+}
+
+// Query returns a new typed query over the kind and namespace of the DSEnt.
+// Soft-deleted entities are excluded, see WithSoftDelete.
+func (db *DSEnt[T]) Query() *Query[T] {
+	q := &Query[T]{
+		db: db,
+		spec: &QuerySpec{
+			Kind:      db.kind,
+			Namespace: db.namespace,
+			Limit:     -1,
+		},
+	}
+	if db.softDelete() {
+		q.spec.Filters = []Filter{db.notDeletedFilter()}
+	}
+	return q
+}
+
+// clone returns a copy of the query that can be modified independently.
+func (q *Query[T]) clone() *Query[T] {
+	return &Query[T]{db: q.db, spec: q.spec.clone(), tx: q.tx}
+}
+
+// Filter returns a derivative query with a property filter.
+// The operator must be one of the operators accepted by datastore.Query.FilterField.
+func (q *Query[T]) Filter(field, op string, value interface{}) *Query[T] {
+	q = q.clone()
+	q.spec.Filters = append(q.spec.Filters, Filter{
+		Field: strings.TrimSpace(field),
+		Op:    strings.TrimSpace(op),
+		Value: value,
+	})
+	return q
+}
+
+// Order returns a derivative query with a sort order.
+// Prefix the field name with a minus sign for descending order.
+func (q *Query[T]) Order(field string) *Query[T] {
+	q = q.clone()
+	field = strings.TrimSpace(field)
+	o := Order{Field: field}
+	if strings.HasPrefix(field, "-") {
+		o = Order{Field: strings.TrimSpace(field[1:]), Desc: true}
+	}
+	q.spec.Orders = append(q.spec.Orders, o)
+	return q
+}
+
+// Limit returns a derivative query with a limit on the number of results.
+// A negative value means unlimited.
+func (q *Query[T]) Limit(limit int) *Query[T] {
+	q = q.clone()
+	q.spec.Limit = limit
+	return q
+}
+
+// Offset returns a derivative query with a number of results to skip.
+func (q *Query[T]) Offset(offset int) *Query[T] {
+	q = q.clone()
+	q.spec.Offset = offset
+	return q
+}
+
+// Ancestor returns a derivative query with an ancestor filter.
+// The namespace of a copy of the ancestor is set to the namespace of the DSEnt.
+func (q *Query[T]) Ancestor(ancestor *datastore.Key) *Query[T] {
+	q = q.clone()
+	q.spec.Ancestor = SetNS(copyKey(ancestor), q.db.namespace)
+	return q
+}
+
+// WithDeleted returns a derivative query that also matches soft-deleted entities.
+func (q *Query[T]) WithDeleted() *Query[T] {
+	q = q.clone()
+	notDeleted := q.db.notDeletedFilter()
+	filters := q.spec.Filters[:0]
+	for _, f := range q.spec.Filters {
+		if f != notDeleted {
+			filters = append(filters, f)
+		}
+	}
+	q.spec.Filters = filters
+	return q
+}
+
+// Transaction returns a derivative query that runs within the given transaction.
+func (q *Query[T]) Transaction(tx Tx) *Query[T] {
+	q = q.clone()
+	q.tx = tx
+	return q
+}
+
+// Spec returns a copy of the backend-agnostic description of the query.
+func (q *Query[T]) Spec() *QuerySpec {
+	return q.spec.clone()
+}
+
+// getAll runs spec within the transaction of the query, if any.
+func (q *Query[T]) getAll(ctx context.Context, spec *QuerySpec, dst interface{}) ([]*datastore.Key, error) {
+	if q.tx != nil {
+		return q.tx.GetAll(spec, dst)
+	}
+	return q.db.backend.GetAll(ctx, spec, dst)
+}
+
+// All runs the query and returns all matching entities with their keys resolved
+// and their AfterLoad hook run.
+// As with Get, entities are returned together with an ErrFieldMismatch error.
+func (q *Query[T]) All(ctx context.Context) (objs []T, err error) {
+	ctx, span := q.startSpan(ctx, "All")
+	defer func() {
+		span.SetAttributes(attrBatchSize.Int(len(objs)))
+		endSpan(span, &err)
+	}()
+	return q.all(ctx)
+}
+
+// all implements All.
+func (q *Query[T]) all(ctx context.Context) ([]T, error) {
+	var objs []T
+	keys, err := q.getAll(ctx, q.spec, &objs)
+	if err != nil {
+		if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+			return nil, err
+		}
+	}
+	for i, key := range keys {
+		if err := q.db.ResolveKey(key, objs[i]); err != nil {
+			return objs, err
+		}
+	}
+	if herr := q.db.afterLoad(ctx, objs...); herr != nil {
+		return objs, herr
+	}
+	return objs, err
+}
+
+// First runs the query and returns the first matching entity.
+// It returns ErrNotFound if nothing matches.
+func (q *Query[T]) First(ctx context.Context) (_ T, err error) {
+	ctx, span := q.startSpan(ctx, "First")
+	defer endSpan(span, &err)
+	objs, err := q.Limit(1).all(ctx)
+	span.SetAttributes(attrBatchSize.Int(len(objs)))
+	if len(objs) == 0 {
+		var zero T
+		if err == nil {
+			err = ErrNotFound
+		}
+		return zero, err
+	}
+	return objs[0], err
+}
+
+// Keys runs the query as a keys-only query and returns the matching keys.
+func (q *Query[T]) Keys(ctx context.Context) (keys []*datastore.Key, err error) {
+	ctx, span := q.startSpan(ctx, "Keys")
+	defer func() {
+		span.SetAttributes(attrBatchSize.Int(len(keys)))
+		endSpan(span, &err)
+	}()
+	return q.keys(ctx)
+}
+
+// keys implements Keys.
+func (q *Query[T]) keys(ctx context.Context) ([]*datastore.Key, error) {
+	spec := q.spec.clone()
+	spec.KeysOnly = true
+	return q.getAll(ctx, spec, nil)
+}
+
+// Count returns the number of entities matching the query.
+func (q *Query[T]) Count(ctx context.Context) (_ int, err error) {
+	ctx, span := q.startSpan(ctx, "Count")
+	defer endSpan(span, &err)
+	if q.tx != nil {
+		keys, err := q.keys(ctx)
+		return len(keys), err
+	}
+	return q.db.backend.Count(ctx, q.spec)
+}
@@ -0,0 +1,103 @@
+package dsent
+
+import (
+	"context"
+	"sync"
+
+	"cloud.google.com/go/datastore"
+)
+
+// flightGroup coalesces the concurrent reads of the same entities, see WithCoalescing.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+// flightCall is the read of an entity, shared by the lookups waiting for it.
+type flightCall struct {
+	done  chan struct{}
+	props datastore.PropertyList
+	err   error
+	// dups is the number of lookups that joined the call.
+	dups int
+}
+
+// fetch reads the entities of keys from the backend like Backend.GetMulti,
+// coalescing the reads of the entities already being read with WithCoalescing.
+func (db *DSEnt[T]) fetch(ctx context.Context, keys []*datastore.Key) ([]datastore.PropertyList, error) {
+	props := make([]datastore.PropertyList, len(keys))
+	if !db.opts.coalesce {
+		return props, db.backend.GetMulti(ctx, keys, props)
+	}
+	return props, db.flights.do(ctx, db.backend, keys, props)
+}
+
+// do reads the entities of keys into props. The keys that are not being read
+// are read with a single call of backend.GetMulti, the others wait for the
+// calls reading them. Errors are reported with a datastore.MultiError.
+func (g *flightGroup) do(ctx context.Context, backend Backend, keys []*datastore.Key, props []datastore.PropertyList) error {
+	calls := make([]*flightCall, len(keys))
+	var own []int
+	g.mu.Lock()
+	for i, key := range keys {
+		ks := keyString(key)
+		if c, ok := g.calls[ks]; ok {
+			c.dups++
+			calls[i] = c
+			continue
+		}
+		calls[i] = &flightCall{done: make(chan struct{})}
+		g.calls[ks] = calls[i]
+		own = append(own, i)
+	}
+	g.mu.Unlock()
+
+	if len(own) > 0 {
+		ownKeys := make([]*datastore.Key, len(own))
+		for j, i := range own {
+			ownKeys[j] = keys[i]
+		}
+		fetched := make([]datastore.PropertyList, len(own))
+		err := backend.GetMulti(ctx, ownKeys, fetched)
+		merr, _ := err.(datastore.MultiError)
+		g.mu.Lock()
+		for j, i := range own {
+			c := calls[i]
+			c.props = fetched[j]
+			c.err = err
+			if merr != nil {
+				c.err = merr[j]
+			}
+			delete(g.calls, keyString(keys[i]))
+		}
+		g.mu.Unlock()
+		for _, i := range own {
+			close(calls[i].done)
+		}
+	}
+
+	errs := make(datastore.MultiError, len(keys))
+	failed := false
+	for i, c := range calls {
+		select {
+		case <-c.done:
+			errs[i] = c.err
+			props[i] = copyProperties(c.props)
+			if (errs[i] == context.Canceled || errs[i] == context.DeadlineExceeded) && ctx.Err() == nil {
+				// the context of the lookup that read the entity is done, not ours
+				var ps datastore.PropertyList
+				errs[i] = backend.Get(ctx, keys[i], &ps)
+				props[i] = ps
+			}
+		case <-ctx.Done():
+			errs[i] = ctx.Err()
+		}
+		if errs[i] != nil {
+			failed = true
+		}
+	}
+	if failed {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package dsent
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingBackend is a MemoryBackend whose GetMulti calls block until release is closed.
+type blockingBackend struct {
+	*MemoryBackend
+	calls   atomic.Int32
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingBackend) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	if b.calls.Add(1) == 1 {
+		close(b.started)
+	}
+	select {
+	case <-b.release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return b.MemoryBackend.GetMulti(ctx, keys, dst)
+}
+
+// waitDups waits until n lookups joined the read of key.
+func waitDups(t *testing.T, g *flightGroup, key *datastore.Key, n int) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		c, ok := g.calls[keyString(key)]
+		return ok && c.dups == n
+	}, time.Second, time.Millisecond)
+}
+
+func TestCoalescing(t *testing.T) {
+	ctx := context.Background()
+	backend := &blockingBackend{MemoryBackend: NewMemoryBackend(), started: make(chan struct{}), release: make(chan struct{})}
+	db := newDSEnt[*memoryObj](t, backend, "Memory", WithCoalescing())
+	_, _, err := db.BatchCreate(ctx, []*memoryObj{{ID: 1, Name: "a", Tags: []string{"x"}}, {ID: 2, Name: "b"}})
+	require.NoError(t, err)
+
+	const n = 5
+	objs := make([]*memoryObj, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		objs[0], errs[0] = db.Get(ctx, &memoryObj{ID: 1})
+	}()
+	<-backend.started
+	for i := 1; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				objs[i], errs[i] = db.Get(ctx, &memoryObj{ID: 1})
+				return
+			}
+			got, err := db.BatchGet(ctx, []*memoryObj{{ID: 1}, {ID: 1}})
+			objs[i], errs[i] = got[1], err
+		}(i)
+	}
+	// two BatchGet calls looking up the key twice, and two Get calls
+	waitDups(t, db.flights, datastore.IDKey("Memory", 1, nil), 6)
+	close(backend.release)
+	wg.Wait()
+
+	require.Equal(t, int32(1), backend.calls.Load())
+	for i, obj := range objs {
+		require.NoError(t, errs[i])
+		require.Equal(t, "a", obj.Name)
+		require.Equal(t, int64(1), obj.ID)
+	}
+	// every caller gets its own copy
+	objs[0].Tags[0] = "y"
+	require.Equal(t, []string{"x"}, objs[1].Tags)
+
+	// reads are not coalesced once done
+	_, err = db.Get(ctx, &memoryObj{ID: 1})
+	require.NoError(t, err)
+	_, err = db.Get(ctx, &memoryObj{ID: 3})
+	require.ErrorIs(t, err, ErrNotFound)
+	require.Equal(t, int32(3), backend.calls.Load())
+	require.Empty(t, db.flights.calls)
+}
+
+func TestCoalescingCanceled(t *testing.T) {
+	ctx := context.Background()
+	backend := &blockingBackend{MemoryBackend: NewMemoryBackend(), started: make(chan struct{}), release: make(chan struct{})}
+	db := newDSEnt[*memoryObj](t, backend, "Memory", WithCoalescing())
+	_, _, err := db.Create(ctx, &memoryObj{ID: 1, Name: "a"})
+	require.NoError(t, err)
+
+	// the context of the first lookup is canceled, the second one reads again
+	first, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	var firstErr, secondErr error
+	var second *memoryObj
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, firstErr = db.Get(first, &memoryObj{ID: 1})
+	}()
+	<-backend.started
+	go func() {
+		defer wg.Done()
+		second, secondErr = db.Get(ctx, &memoryObj{ID: 1})
+	}()
+	waitDups(t, db.flights, datastore.IDKey("Memory", 1, nil), 1)
+	cancel()
+	wg.Wait()
+	close(backend.release)
+
+	require.ErrorIs(t, firstErr, context.Canceled)
+	require.NoError(t, secondErr)
+	require.Equal(t, "a", second.Name)
+}
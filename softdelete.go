@@ -0,0 +1,243 @@
+package dsent
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// ErrSoftDeleteDisabled is returned by Restore when the DSEnt does not use WithSoftDelete.
+var ErrSoftDeleteDisabled = errors.New("soft delete is not enabled")
+
+// SoftDeletable is implemented by objects that can be soft deleted, see WithSoftDelete.
+// The deleted-at time must be stored as the property given to WithSoftDelete,
+// and be the zero time while the entity is not deleted, e.g.
+//
+//	type User struct {
+//		Deleted time.Time `datastore:"deleted_at"`
+//	}
+//
+//	func (u *User) DeletedAt() time.Time     { return u.Deleted }
+//	func (u *User) SetDeletedAt(t time.Time) { u.Deleted = t }
+type SoftDeletable interface {
+	DeletedAt() time.Time
+	SetDeletedAt(t time.Time)
+}
+
+// softDelete reports whether the DSEnt soft deletes its entities.
+func (db *DSEnt[T]) softDelete() bool {
+	return db.opts.softDeleteProperty != ""
+}
+
+// deleted reports whether obj is soft deleted.
+func (db *DSEnt[T]) deleted(obj T) bool {
+	if !db.softDelete() {
+		return false
+	}
+	return !interface{}(obj).(SoftDeletable).DeletedAt().IsZero()
+}
+
+// deletedProperties reports whether the properties of an entity mark it as soft deleted.
+func (db *DSEnt[T]) deletedProperties(props datastore.PropertyList) bool {
+	for _, p := range props {
+		if p.Name == db.opts.softDeleteProperty {
+			t, ok := p.Value.(time.Time)
+			return ok && !t.IsZero()
+		}
+	}
+	return false
+}
+
+// notDeletedFilter is the filter excluding soft-deleted entities from queries.
+func (db *DSEnt[T]) notDeletedFilter() Filter {
+	return Filter{Field: db.opts.softDeleteProperty, Op: "=", Value: time.Time{}}
+}
+
+// hideDeleted reports the soft-deleted objects loaded by a batch get that
+// returned err as not found.
+func (db *DSEnt[T]) hideDeleted(objs []T, keys []*datastore.Key, err error) error {
+	if !db.softDelete() {
+		return err
+	}
+	berr, isBatch := err.(*BatchError[T])
+	if !isBatch && !loaded(err) {
+		return err
+	}
+	var errs datastore.MultiError
+	if isBatch {
+		errs = berr.Errs
+	}
+	for i, obj := range objs {
+		if (errs != nil && !loaded(errs[i])) || !db.deleted(obj) {
+			continue
+		}
+		if errs == nil {
+			errs = make(datastore.MultiError, len(objs))
+		}
+		errs[i] = ErrNotFound
+	}
+	if errs == nil {
+		return err
+	}
+	return newBatchError(objs, keys, errs)
+}
+
+// loadTx loads the entity stored for key into obj within tx. A soft-deleted
+// entity is not loaded and reported as not found, with tombstone set.
+func (db *DSEnt[T]) loadTx(tx Tx, key *datastore.Key, obj T) (tombstone bool, err error) {
+	if !db.softDelete() {
+		return false, tx.Get(key, obj)
+	}
+	var props datastore.PropertyList
+	if err := tx.Get(key, &props); err != nil {
+		return false, err
+	}
+	if db.deletedProperties(props) {
+		return true, datastore.ErrNoSuchEntity
+	}
+	return false, db.loadProperties(key, props, obj)
+}
+
+// softDeleteTx marks the entities of objs as deleted within tx. Entities that
+// do not exist or are already deleted are left as is.
+func (db *DSEnt[T]) softDeleteTx(tx Tx, keys []*datastore.Key, objs []T) error {
+	stored := make([]T, len(objs))
+	for i := range stored {
+		stored[i] = newObject[T]()
+	}
+	errs := make(datastore.MultiError, len(objs))
+	if err := tx.GetMulti(keys, stored); err != nil {
+		merr, ok := err.(datastore.MultiError)
+		if !ok {
+			return err
+		}
+		errs = merr
+	}
+	now := db.opts.now().Truncate(time.Microsecond)
+	var deletedKeys []*datastore.Key
+	var before [][]datastore.Property
+	var after []T
+	var index []int
+	for i, obj := range stored {
+		if errs[i] == datastore.ErrNoSuchEntity {
+			continue
+		} else if errs[i] != nil {
+			return errs[i]
+		} else if db.deleted(obj) {
+			continue
+		}
+		if db.audited() {
+			ps, err := obj.Save()
+			if err != nil {
+				return err
+			}
+			before = append(before, ps)
+		}
+		interface{}(obj).(SoftDeletable).SetDeletedAt(now)
+		deletedKeys = append(deletedKeys, keys[i])
+		after = append(after, obj)
+		index = append(index, i)
+	}
+	if len(after) == 0 {
+		return nil
+	}
+	// the deleted entities are written as updates
+	if err := db.prepareWrite(tx.Context(), OpUpdate, after); err != nil {
+		return err
+	}
+	muts := make([]*Mutation, len(after))
+	for j, obj := range after {
+		db.bumpVersion(obj)
+		muts[j] = &Mutation{Op: OpUpdate, Key: deletedKeys[j], Src: obj}
+	}
+	if _, err := tx.Mutate(muts...); err != nil {
+		return err
+	}
+	for _, i := range index {
+		interface{}(objs[i]).(SoftDeletable).SetDeletedAt(now)
+	}
+	db.invalidateTx(tx, deletedKeys...)
+	return db.auditTx(tx, OpDelete, deletedKeys, before, after)
+}
+
+// Restore restores a soft-deleted entity and loads it into obj.
+// It returns ErrNotFound if the entity does not exist, and does nothing if it
+// is not deleted.
+func (db *DSEnt[T]) Restore(ctx context.Context, obj T) (_ T, err error) {
+	ctx, span := db.startSpan(ctx, "Restore", 1)
+	defer endSpan(span, &err)
+	_, err = db.runInTransaction(ctx, func(tx Tx) error {
+		var err error
+		obj, err = db.restoreTx(tx, obj)
+		return err
+	})
+	return obj, err
+}
+
+// RestoreTx restores a soft-deleted entity within a transaction, see Restore.
+func (db *DSEnt[T]) RestoreTx(tx Tx, obj T) (_ T, err error) {
+	span := db.startSpanTx(tx, "RestoreTx", 1)
+	defer endSpan(span, &err)
+	return db.restoreTx(tx, obj)
+}
+
+// restoreTx implements RestoreTx.
+func (db *DSEnt[T]) restoreTx(tx Tx, obj T) (T, error) {
+	if !db.softDelete() {
+		return obj, ErrSoftDeleteDisabled
+	}
+	key, err := obj.BuildKey(db.namespace)
+	if err != nil {
+		return obj, err
+	}
+	if err := tx.Get(key, obj); err != nil {
+		return obj, err
+	}
+	if !db.deleted(obj) {
+		return obj, nil
+	}
+	interface{}(obj).(SoftDeletable).SetDeletedAt(time.Time{})
+	if _, err := db.writeTx(tx, OpUpdate, []T{obj}); err != nil {
+		return obj, err
+	}
+	return obj, db.ResolveKey(key, obj)
+}
+
+// Purge permanently deletes an entity, whether or not it is soft deleted.
+// It runs the BeforeDelete hook of obj.
+func (db *DSEnt[T]) Purge(ctx context.Context, obj T) (err error) {
+	ctx, span := db.startSpan(ctx, "Purge", 1)
+	defer endSpan(span, &err)
+	if err := db.beforeDelete(ctx, obj); err != nil {
+		return err
+	}
+	key, err := obj.BuildKey(db.namespace)
+	if err != nil {
+		return err
+	}
+	if db.audited() {
+		_, err = db.runInTransaction(ctx, func(tx Tx) error {
+			return db.purgeTx(tx, []*datastore.Key{key})
+		})
+		return err
+	}
+	_, err = db.backend.Mutate(ctx, NewDelete(key))
+	db.invalidate(key)
+	return err
+}
+
+// PurgeTx permanently deletes an entity within a transaction, see Purge.
+func (db *DSEnt[T]) PurgeTx(tx Tx, obj T) (err error) {
+	span := db.startSpanTx(tx, "PurgeTx", 1)
+	defer endSpan(span, &err)
+	if err := db.beforeDelete(tx.Context(), obj); err != nil {
+		return err
+	}
+	key, err := obj.BuildKey(db.namespace)
+	if err != nil {
+		return err
+	}
+	return db.purgeTx(tx, []*datastore.Key{key})
+}
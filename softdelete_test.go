@@ -0,0 +1,233 @@
+package dsent
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	_ SoftDeletable = (*softObj)(nil)
+	_ SoftDeletable = (*softTimedObj)(nil)
+	_ Timestamped   = (*softTimedObj)(nil)
+)
+
+type softObj struct {
+	ID      int64     `datastore:"-"`
+	Name    string    `datastore:"name"`
+	Deleted time.Time `datastore:"deleted_at"`
+}
+
+func (x *softObj) BuildKey(ns string) (*datastore.Key, error) {
+	return SetNS(datastore.IDKey("Soft", x.ID, nil), ns), nil
+}
+
+func (x *softObj) LoadKey(k *datastore.Key) error {
+	x.ID = k.ID
+	return nil
+}
+
+func (x *softObj) Load(ps []datastore.Property) error {
+	return datastore.LoadStruct(x, ps)
+}
+
+func (x *softObj) Save() ([]datastore.Property, error) {
+	return datastore.SaveStruct(x)
+}
+
+func (x *softObj) DeletedAt() time.Time {
+	return x.Deleted
+}
+
+func (x *softObj) SetDeletedAt(t time.Time) {
+	x.Deleted = t
+}
+
+type softTimedObj struct {
+	ID        int64     `datastore:"-"`
+	Name      string    `datastore:"name"`
+	UpdatedAt time.Time `datastore:"updated_at"`
+	Deleted   time.Time `datastore:"deleted_at"`
+}
+
+func (x *softTimedObj) BuildKey(ns string) (*datastore.Key, error) {
+	return SetNS(datastore.IDKey("SoftTimed", x.ID, nil), ns), nil
+}
+
+func (x *softTimedObj) LoadKey(k *datastore.Key) error {
+	x.ID = k.ID
+	return nil
+}
+
+func (x *softTimedObj) Load(ps []datastore.Property) error {
+	return datastore.LoadStruct(x, ps)
+}
+
+func (x *softTimedObj) Save() ([]datastore.Property, error) {
+	return datastore.SaveStruct(x)
+}
+
+func (x *softTimedObj) DeletedAt() time.Time {
+	return x.Deleted
+}
+
+func (x *softTimedObj) SetDeletedAt(t time.Time) {
+	x.Deleted = t
+}
+
+func (x *softTimedObj) SetCreatedAt(time.Time) {}
+
+func (x *softTimedObj) SetUpdatedAt(t time.Time) {
+	x.UpdatedAt = t
+}
+
+func (x *softTimedObj) Validate() error {
+	if x.Name == "invalid" {
+		return errors.New("invalid")
+	}
+	return nil
+}
+
+func TestSoftDelete(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	db := newMemoryDSEnt[*softObj](t, "Soft", WithSoftDelete("deleted_at"), WithClock(func() time.Time { return now }))
+
+	_, _, err := db.BatchCreate(ctx, []*softObj{{ID: 1, Name: "a"}, {ID: 2, Name: "b"}, {ID: 3, Name: "c"}})
+	require.NoError(t, err)
+
+	obj := &softObj{ID: 1}
+	require.NoError(t, db.Delete(ctx, obj))
+	require.Equal(t, now, obj.Deleted)
+	// deleting again, or something that does not exist, is a no-op
+	require.NoError(t, db.Delete(ctx, &softObj{ID: 1}))
+	require.NoError(t, db.Delete(ctx, &softObj{ID: 4}))
+
+	_, err = db.Get(ctx, &softObj{ID: 1})
+	require.ErrorIs(t, err, ErrNotFound)
+	ok, err := db.Exists(ctx, &softObj{ID: 1})
+	require.NoError(t, err)
+	require.False(t, ok)
+	objs, err := db.BatchGet(ctx, []*softObj{{ID: 1}, {ID: 2}})
+	berr, isBatch := err.(*BatchError[*softObj])
+	require.True(t, isBatch)
+	require.ErrorIs(t, berr.Errs[0], ErrNotFound)
+	require.NoError(t, berr.Errs[1])
+	require.Equal(t, "b", objs[1].Name)
+	_, err = db.RunInTransaction(ctx, func(tx Tx) error {
+		_, err := db.GetTx(tx, &softObj{ID: 1})
+		require.ErrorIs(t, err, ErrNotFound)
+		ok, err := db.ExistsTx(ctx, tx, &softObj{ID: 1})
+		require.NoError(t, err)
+		require.False(t, ok)
+		return nil
+	})
+	require.NoError(t, err)
+
+	// queries exclude soft-deleted entities unless asked to
+	n, err := db.Query().Count(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	all, err := db.Query().WithDeleted().Order("name").All(ctx)
+	require.NoError(t, err)
+	require.Len(t, all, 3)
+	require.Equal(t, now, all[0].Deleted)
+
+	require.NoError(t, db.BatchDelete(ctx, []*softObj{{ID: 2}}))
+	require.NoError(t, db.BulkDelete(ctx, []*softObj{{ID: 3}}))
+	n, err = db.Query().Count(ctx)
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	obj, err = db.Restore(ctx, &softObj{ID: 1})
+	require.NoError(t, err)
+	require.Equal(t, "a", obj.Name)
+	require.True(t, obj.Deleted.IsZero())
+	obj, err = db.Get(ctx, &softObj{ID: 1})
+	require.NoError(t, err)
+	require.Equal(t, "a", obj.Name)
+	_, err = db.Restore(ctx, &softObj{ID: 4})
+	require.ErrorIs(t, err, ErrNotFound)
+
+	// updates do not see soft-deleted entities, creating replaces them
+	_, err = db.Update(ctx, &softObj{ID: 2}, func(x *softObj) (*softObj, error) { return x, nil }, nil)
+	require.ErrorIs(t, err, ErrNotFound)
+	obj, err = db.Update(ctx, &softObj{ID: 2}, func(x *softObj) (*softObj, error) {
+		x.Name = "new"
+		return x, nil
+	}, func(x *softObj) (*softObj, error) { return x, nil })
+	require.NoError(t, err)
+	require.Equal(t, "new", obj.Name)
+	require.True(t, obj.Deleted.IsZero())
+
+	require.NoError(t, db.Purge(ctx, &softObj{ID: 3}))
+	all, err = db.Query().WithDeleted().All(ctx)
+	require.NoError(t, err)
+	require.Len(t, all, 2)
+
+	// creating replaces soft-deleted entities, but not the others
+	require.NoError(t, db.Delete(ctx, &softObj{ID: 1}))
+	_, _, err = db.Create(ctx, &softObj{ID: 1, Name: "created"})
+	require.NoError(t, err)
+	obj, err = db.Get(ctx, &softObj{ID: 1})
+	require.NoError(t, err)
+	require.Equal(t, "created", obj.Name)
+	_, _, err = db.Create(ctx, &softObj{ID: 1})
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+	require.NoError(t, db.Delete(ctx, &softObj{ID: 1}))
+	_, _, err = db.BulkCreate(ctx, []*softObj{{ID: 1, Name: "bulk"}, {ID: 5}})
+	require.NoError(t, err)
+	obj, err = db.Get(ctx, &softObj{ID: 1})
+	require.NoError(t, err)
+	require.Equal(t, "bulk", obj.Name)
+}
+
+func TestSoftDeleteWrites(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	db := newMemoryDSEnt[*softTimedObj](t, "SoftTimed", WithSoftDelete("deleted_at"), WithClock(func() time.Time { return now }))
+
+	_, _, err := db.Create(ctx, &softTimedObj{ID: 1, Name: "a"})
+	require.NoError(t, err)
+
+	// soft deletes and restores are written like updates
+	now = now.Add(time.Hour)
+	require.NoError(t, db.Delete(ctx, &softTimedObj{ID: 1}))
+	all, err := db.Query().WithDeleted().All(ctx)
+	require.NoError(t, err)
+	require.Len(t, all, 1)
+	require.Equal(t, now, all[0].UpdatedAt)
+	require.Equal(t, now, all[0].Deleted)
+	now = now.Add(time.Hour)
+	obj, err := db.Restore(ctx, &softTimedObj{ID: 1})
+	require.NoError(t, err)
+	require.Equal(t, now, obj.UpdatedAt)
+	obj, err = db.Get(ctx, &softTimedObj{ID: 1})
+	require.NoError(t, err)
+	require.Equal(t, now, obj.UpdatedAt)
+
+	// a soft delete that fails validation is not written
+	_, err = db.Backend().Mutate(ctx, NewUpsert(SetNS(datastore.IDKey("SoftTimed", 2, nil), ""), &softTimedObj{Name: "invalid"}))
+	require.NoError(t, err)
+	obj = &softTimedObj{ID: 2}
+	require.Error(t, db.Delete(ctx, obj))
+	require.True(t, obj.Deleted.IsZero())
+	ok, err := db.Exists(ctx, &softTimedObj{ID: 2})
+	require.NoError(t, err)
+	require.True(t, ok)
+}
+
+func TestSoftDeleteOptions(t *testing.T) {
+	_, err := TryNewDSEntWithBackend[*memoryObj](NewMemoryBackend(), "", "Memory", WithRegistry(NewRegistry()), WithSoftDelete("deleted_at"))
+	require.Error(t, err)
+
+	db := newMemoryDSEnt[*softObj](t, "Soft")
+	_, err = db.Restore(context.Background(), &softObj{ID: 1})
+	require.ErrorIs(t, err, ErrSoftDeleteDisabled)
+}
@@ -0,0 +1,29 @@
+package dsent
+
+import "time"
+
+// Timestamped is implemented by objects whose creation and update times are
+// managed by DSEnt.
+//
+// Create, BatchCreate, BulkCreate, their *Tx variants and the created branch
+// of Update set both times. Put and Update only set the update time. Times come
+// from the clock set with WithClock, truncated to the microsecond precision of
+// Datastore, and are set once the hooks and validation of the write passed,
+// so that a rejected write leaves the object unchanged.
+type Timestamped interface {
+	SetCreatedAt(t time.Time)
+	SetUpdatedAt(t time.Time)
+}
+
+// setTimestamps sets the timestamps of obj for a write mutation.
+func (db *DSEnt[T]) setTimestamps(op MutationOp, obj T) {
+	ts, ok := interface{}(obj).(Timestamped)
+	if !ok {
+		return
+	}
+	now := db.opts.now().Truncate(time.Microsecond)
+	if op == OpInsert {
+		ts.SetCreatedAt(now)
+	}
+	ts.SetUpdatedAt(now)
+}
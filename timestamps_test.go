@@ -0,0 +1,113 @@
+package dsent
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+var _ Timestamped = (*timedObj)(nil)
+
+type timedObj struct {
+	ID        int64     `datastore:"-"`
+	Name      string    `datastore:"name"`
+	CreatedAt time.Time `datastore:"created_at"`
+	UpdatedAt time.Time `datastore:"updated_at"`
+
+	// invalid makes Validate fail.
+	invalid bool
+}
+
+func (x *timedObj) BuildKey(ns string) (*datastore.Key, error) {
+	return SetNS(datastore.IDKey("Timed", x.ID, nil), ns), nil
+}
+
+func (x *timedObj) Load(ps []datastore.Property) error {
+	return datastore.LoadStruct(x, ps)
+}
+
+func (x *timedObj) Save() ([]datastore.Property, error) {
+	return datastore.SaveStruct(x)
+}
+
+func (x *timedObj) SetCreatedAt(t time.Time) {
+	x.CreatedAt = t
+}
+
+func (x *timedObj) SetUpdatedAt(t time.Time) {
+	x.UpdatedAt = t
+}
+
+func (x *timedObj) Validate() error {
+	if x.invalid {
+		return errors.New("invalid")
+	}
+	return nil
+}
+
+func TestTimestamps(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 2, 3, 4, 5, 6789, time.UTC)
+	clock := func() time.Time { return now }
+	db := newMemoryDSEnt[*timedObj](t, "Timed", WithClock(clock))
+	created := now.Truncate(time.Microsecond)
+
+	_, obj, err := db.Create(ctx, &timedObj{ID: 1})
+	require.NoError(t, err)
+	require.Equal(t, created, obj.CreatedAt)
+	require.Equal(t, created, obj.UpdatedAt)
+
+	now = now.Add(time.Hour)
+	obj, err = db.Update(ctx, &timedObj{ID: 1}, func(x *timedObj) (*timedObj, error) {
+		x.Name = "a"
+		return x, nil
+	}, nil)
+	require.NoError(t, err)
+	require.Equal(t, created, obj.CreatedAt)
+	require.Equal(t, created.Add(time.Hour), obj.UpdatedAt)
+
+	stored, err := db.Get(ctx, &timedObj{ID: 1})
+	require.NoError(t, err)
+	require.Equal(t, obj.CreatedAt, stored.CreatedAt)
+	require.Equal(t, obj.UpdatedAt, stored.UpdatedAt)
+
+	// Put only sets the update time
+	now = now.Add(time.Hour)
+	_, obj, err = db.Put(ctx, stored)
+	require.NoError(t, err)
+	require.Equal(t, created, obj.CreatedAt)
+	require.Equal(t, created.Add(2*time.Hour), obj.UpdatedAt)
+	_, obj, err = db.Put(ctx, &timedObj{ID: 2})
+	require.NoError(t, err)
+	require.True(t, obj.CreatedAt.IsZero())
+
+	// the created branch of Update sets both
+	obj, err = db.Update(ctx, &timedObj{ID: 3}, func(x *timedObj) (*timedObj, error) {
+		return x, nil
+	}, func(x *timedObj) (*timedObj, error) {
+		return x, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, created.Add(2*time.Hour), obj.CreatedAt)
+	require.Equal(t, obj.CreatedAt, obj.UpdatedAt)
+
+	_, objs, err := db.BatchCreate(ctx, []*timedObj{{ID: 4}, {ID: 5}})
+	require.NoError(t, err)
+	for _, obj := range objs {
+		require.Equal(t, created.Add(2*time.Hour), obj.CreatedAt)
+	}
+
+	// a rejected write leaves the times unchanged
+	now = now.Add(time.Hour)
+	_, _, err = db.BatchPut(ctx, []*timedObj{objs[0], {ID: 6, invalid: true}})
+	require.ErrorIs(t, err, ErrInvalidEntity)
+	require.Equal(t, created.Add(2*time.Hour), objs[0].UpdatedAt)
+	invalid := &timedObj{ID: 6, invalid: true}
+	_, _, err = db.Create(ctx, invalid)
+	require.ErrorIs(t, err, ErrInvalidEntity)
+	require.True(t, invalid.CreatedAt.IsZero())
+}
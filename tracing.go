@@ -0,0 +1,85 @@
+package dsent
+
+import (
+	"context"
+	"errors"
+
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// tracerName is the instrumentation name of the tracers of DSEnt.
+const tracerName = "pkg.lucas.icu/dsent"
+
+// Attributes of the spans of a DSEnt, see WithTracerProvider.
+const (
+	attrKind      = attribute.Key("dsent.kind")
+	attrNamespace = attribute.Key("dsent.namespace")
+	attrOperation = attribute.Key("dsent.operation")
+	attrBatchSize = attribute.Key("dsent.batch_size")
+	attrTxAttempt = attribute.Key("dsent.tx.attempt")
+	attrErrorCode = attribute.Key("dsent.error_code")
+)
+
+// startSpan starts the span of the operation op of the DSEnt on n entities.
+// A negative n leaves the batch size unset, e.g. for queries until they return.
+func (db *DSEnt[T]) startSpan(ctx context.Context, op string, n int) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{
+		attrKind.String(db.kind),
+		attrNamespace.String(db.namespace),
+		attrOperation.String(op),
+	}
+	if n >= 0 {
+		attrs = append(attrs, attrBatchSize.Int(n))
+	}
+	return db.tracer.Start(ctx, "dsent."+op, trace.WithAttributes(attrs...))
+}
+
+// startSpanTx is like startSpan for an operation within tx. The span records
+// the attempt of tx if it is a ManagedTx.
+func (db *DSEnt[T]) startSpanTx(tx Tx, op string, n int) trace.Span {
+	_, span := db.startSpan(tx.Context(), op, n)
+	if mtx, ok := tx.(*ManagedTx); ok {
+		span.SetAttributes(attrTxAttempt.Int(mtx.Attempt()))
+	}
+	return span
+}
+
+// startSpan starts the span of the operation op of the query, see DSEnt.startSpan.
+// The span records the attempt of the transaction of the query if it is a ManagedTx.
+func (q *Query[T]) startSpan(ctx context.Context, op string) (context.Context, trace.Span) {
+	ctx, span := q.db.startSpan(ctx, "Query."+op, -1)
+	if mtx, ok := q.tx.(*ManagedTx); ok {
+		span.SetAttributes(attrTxAttempt.Int(mtx.Attempt()))
+	}
+	return ctx, span
+}
+
+// endSpan records the error pointed to by errp on span, if any, and ends it.
+func endSpan(span trace.Span, errp *error) {
+	if err := *errp; err != nil {
+		span.SetAttributes(attrErrorCode.String(errorCode(err).String()))
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+	}
+	span.End()
+}
+
+// errorCode returns the gRPC code of err, mapping the errors of Datastore and
+// of contexts to their equivalent code.
+func errorCode(err error) codes.Code {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return codes.NotFound
+	case errors.Is(err, ErrConcurrentTransaction):
+		return codes.Aborted
+	case errors.Is(err, context.Canceled):
+		return codes.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return codes.DeadlineExceeded
+	}
+	return status.Code(err)
+}
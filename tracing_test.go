@@ -0,0 +1,89 @@
+package dsent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// spanAttrs returns the attributes of span by key.
+func spanAttrs(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range span.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+func TestTracing(t *testing.T) {
+	ctx := context.Background()
+	rec := tracetest.NewSpanRecorder()
+	backend := &abortBackend{MemoryBackend: NewMemoryBackend()}
+	db := newDSEnt[*memoryObj](t, backend, "Memory",
+		WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))),
+		WithTxOptions(WithTxBackoff(func(int) time.Duration { return 0 })))
+
+	_, _, err := db.BatchCreate(ctx, []*memoryObj{{ID: 1, Name: "a"}, {ID: 2, Name: "b"}})
+	require.NoError(t, err)
+	_, err = db.Get(ctx, &memoryObj{ID: 3})
+	require.ErrorIs(t, err, ErrNotFound)
+	backend.aborts = 1
+	_, err = db.Update(ctx, &memoryObj{ID: 1}, func(obj *memoryObj) (*memoryObj, error) {
+		obj.Name = "c"
+		return obj, nil
+	}, nil)
+	require.NoError(t, err)
+	_, err = db.Query().All(ctx)
+	require.NoError(t, err)
+	_, err = db.Transact(ctx, func(tx *ManagedTx) error {
+		_, err := db.GetTx(tx, &memoryObj{ID: 1})
+		return err
+	})
+	require.NoError(t, err)
+
+	spans := rec.Ended()
+	names := make([]string, len(spans))
+	for i, span := range spans {
+		names[i] = span.Name()
+	}
+	// a method does not start the spans of the methods it is implemented with
+	require.Equal(t, []string{"dsent.BatchCreate", "dsent.Get", "dsent.Update", "dsent.Query.All", "dsent.GetTx", "dsent.Transact"}, names)
+
+	attrs := spanAttrs(spans[0])
+	require.Equal(t, "Memory", attrs[attrKind].AsString())
+	require.Equal(t, "", attrs[attrNamespace].AsString())
+	require.Equal(t, "BatchCreate", attrs[attrOperation].AsString())
+	require.Equal(t, int64(2), attrs[attrBatchSize].AsInt64())
+	require.Equal(t, int64(1), attrs[attrTxAttempt].AsInt64())
+	require.Equal(t, otelcodes.Unset, spans[0].Status().Code)
+
+	attrs = spanAttrs(spans[1])
+	require.Equal(t, "NotFound", attrs[attrErrorCode].AsString())
+	require.Equal(t, otelcodes.Error, spans[1].Status().Code)
+	_, ok := attrs[attrTxAttempt]
+	require.False(t, ok)
+
+	// the attempt of the transaction that committed
+	require.Equal(t, int64(2), spanAttrs(spans[2])[attrTxAttempt].AsInt64())
+	// queries record the number of results
+	require.Equal(t, int64(2), spanAttrs(spans[3])[attrBatchSize].AsInt64())
+
+	// the spans of the Tx methods are children of the span of their transaction
+	require.Equal(t, spans[5].SpanContext().SpanID(), spans[4].Parent().SpanID())
+	require.Equal(t, int64(1), spanAttrs(spans[4])[attrTxAttempt].AsInt64())
+	require.Equal(t, "Transact", spanAttrs(spans[5])[attrOperation].AsString())
+}
+
+func TestErrorCode(t *testing.T) {
+	require.Equal(t, "OK", errorCode(nil).String())
+	require.Equal(t, "NotFound", errorCode(&BatchError[*memoryObj]{Errs: []error{nil, ErrNotFound}}).String())
+	require.Equal(t, "Aborted", errorCode(ErrConcurrentTransaction).String())
+	require.Equal(t, "Canceled", errorCode(context.Canceled).String())
+	require.Equal(t, "Unknown", errorCode(ErrUpdateAbort).String())
+}
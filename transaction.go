@@ -0,0 +1,202 @@
+package dsent
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrReadOnlyTx is returned by the Mutate method of a read-only ManagedTx.
+var ErrReadOnlyTx = errors.New("cannot write in a read-only transaction")
+
+// txOptions holds the settings of the transactions run by a DSEnt.
+type txOptions struct {
+	maxAttempts int
+	backoff     func(attempt int) time.Duration
+	readOnly    bool
+	dsOpts      []datastore.TransactionOption
+}
+
+// TxOption configures the transactions run by a DSEnt, see Transact and WithTxOptions.
+type TxOption func(*txOptions)
+
+// WithMaxAttempts sets the number of times a transaction is attempted before
+// its conflict is returned, 3 by default.
+func WithMaxAttempts(n int) TxOption {
+	return func(o *txOptions) {
+		o.maxAttempts = n
+	}
+}
+
+// WithRetries sets the number of times a transaction is retried after a
+// conflict, i.e. WithMaxAttempts(n+1).
+func WithRetries(n int) TxOption {
+	return WithMaxAttempts(n + 1)
+}
+
+// WithTxBackoff sets the delay before retrying a transaction after its given
+// failed attempt, starting at 1. By default it doubles from 50 milliseconds up
+// to 1 second.
+func WithTxBackoff(backoff func(attempt int) time.Duration) TxOption {
+	return func(o *txOptions) {
+		o.backoff = backoff
+	}
+}
+
+// WithReadOnly makes the transaction read-only: its writes fail with ErrReadOnlyTx.
+func WithReadOnly() TxOption {
+	return func(o *txOptions) {
+		o.readOnly = true
+	}
+}
+
+// WithDatastoreTxOptions passes Datastore transaction options to the backend,
+// e.g. datastore.WithReadTime. Retries are handled by DSEnt, so
+// datastore.MaxAttempts has no effect.
+func WithDatastoreTxOptions(opts ...datastore.TransactionOption) TxOption {
+	return func(o *txOptions) {
+		o.dsOpts = append(o.dsOpts, opts...)
+	}
+}
+
+// newTxOptions applies the defaults of a DSEnt, then opts.
+func newTxOptions(defaults, opts []TxOption) txOptions {
+	o := txOptions{maxAttempts: 3, backoff: exponentialBackoff(50*time.Millisecond, time.Second)}
+	for _, opt := range defaults {
+		opt(&o)
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.maxAttempts <= 0 {
+		o.maxAttempts = 1
+	}
+	return o
+}
+
+// exponentialBackoff returns a backoff doubling from base up to max.
+func exponentialBackoff(base, max time.Duration) func(attempt int) time.Duration {
+	return func(attempt int) time.Duration {
+		d := base
+		for i := 1; i < attempt && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			d = max
+		}
+		return d
+	}
+}
+
+// ManagedTx is the Tx given to the function run by Transact.
+// It can be passed to the *Tx methods like any Tx.
+type ManagedTx struct {
+	Tx
+	attempt  int
+	readOnly bool
+
+	mu       sync.Mutex
+	onCommit []func(cmt Commit)
+}
+
+// Attempt returns the attempt of the transaction, starting at 1.
+func (tx *ManagedTx) Attempt() int {
+	return tx.attempt
+}
+
+// OnCommit registers f to be called once the transaction has committed, in
+// the order of registration. Callbacks registered by attempts that do not
+// commit are discarded. It is safe for concurrent use.
+func (tx *ManagedTx) OnCommit(f func(cmt Commit)) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.onCommit = append(tx.onCommit, f)
+}
+
+func (tx *ManagedTx) Mutate(muts ...*Mutation) ([]*PendingKey, error) {
+	if tx.readOnly {
+		return nil, ErrReadOnlyTx
+	}
+	return tx.Tx.Mutate(muts...)
+}
+
+// retryable reports whether a transaction that failed with err can be retried.
+func retryable(err error) bool {
+	return err == datastore.ErrConcurrentTransaction || status.Code(err) == codes.Aborted
+}
+
+// runTx runs f in a transaction of backend, retrying it on conflicts, and
+// calls the OnCommit callbacks of the committed attempt.
+func runTx(ctx context.Context, backend Backend, f func(tx *ManagedTx) error, o txOptions) (Commit, error) {
+	// a single attempt per call, retries are ours
+	dsOpts := append([]datastore.TransactionOption{datastore.MaxAttempts(1)}, o.dsOpts...)
+	if o.readOnly {
+		dsOpts = append(dsOpts, datastore.ReadOnly)
+	}
+	attempt := 0
+	for {
+		var mtx *ManagedTx
+		cmt, err := backend.RunInTransaction(ctx, func(tx Tx) error {
+			attempt++
+			if attempt > o.maxAttempts {
+				// the backend retries on its own
+				return datastore.ErrConcurrentTransaction
+			}
+			mtx = &ManagedTx{Tx: tx, attempt: attempt, readOnly: o.readOnly}
+			return f(mtx)
+		}, dsOpts...)
+		if err == nil {
+			mtx.mu.Lock()
+			onCommit := mtx.onCommit
+			mtx.mu.Unlock()
+			for _, cb := range onCommit {
+				cb(cmt)
+			}
+			return cmt, nil
+		}
+		if !retryable(err) || attempt >= o.maxAttempts {
+			return nil, err
+		}
+		timer := time.NewTimer(o.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Transact runs f in a transaction, retrying it with a backoff if it
+// conflicts, and calls the OnCommit callbacks registered on the ManagedTx
+// once it has committed. The options override those of WithTxOptions.
+//
+// f may be called several times, and should not have side effects other than
+// through the transaction: defer them with OnCommit.
+func (db *DSEnt[T]) Transact(ctx context.Context, f func(tx *ManagedTx) error, opts ...TxOption) (_ Commit, err error) {
+	ctx, span := db.startSpan(ctx, "Transact", -1)
+	defer endSpan(span, &err)
+	return db.transact(ctx, span, f, opts)
+}
+
+// transact implements Transact, recording the attempts of the transaction on span.
+func (db *DSEnt[T]) transact(ctx context.Context, span trace.Span, f func(tx *ManagedTx) error, opts []TxOption) (Commit, error) {
+	return runTx(ctx, db.backend, func(tx *ManagedTx) error {
+		span.SetAttributes(attrTxAttempt.Int(tx.Attempt()))
+		return f(tx)
+	}, newTxOptions(db.opts.txOptions, opts))
+}
+
+// runInTransaction runs f in a transaction with the options of the DSEnt, for
+// the operation whose span is in ctx.
+func (db *DSEnt[T]) runInTransaction(ctx context.Context, f func(tx Tx) error) (Commit, error) {
+	return db.transact(ctx, trace.SpanFromContext(ctx), func(tx *ManagedTx) error {
+		return f(tx)
+	}, nil)
+}
@@ -0,0 +1,149 @@
+package dsent
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+// abortBackend is a MemoryBackend whose next transactions fail with a conflict
+// after running their function.
+type abortBackend struct {
+	*MemoryBackend
+	aborts int
+}
+
+func (b *abortBackend) RunInTransaction(ctx context.Context, f func(tx Tx) error, opts ...datastore.TransactionOption) (Commit, error) {
+	return b.MemoryBackend.RunInTransaction(ctx, func(tx Tx) error {
+		if err := f(tx); err != nil {
+			return err
+		}
+		if b.aborts > 0 {
+			b.aborts--
+			return datastore.ErrConcurrentTransaction
+		}
+		return nil
+	}, opts...)
+}
+
+func TestTransact(t *testing.T) {
+	ctx := context.Background()
+	backend := &abortBackend{MemoryBackend: NewMemoryBackend()}
+	var backoffs []int
+	db := newDSEnt[*memoryObj](t, backend, "Memory", WithTxOptions(WithTxBackoff(func(attempt int) time.Duration {
+		backoffs = append(backoffs, attempt)
+		return 0
+	})))
+
+	backend.aborts = 2
+	var attempts []int
+	committed := 0
+	_, err := db.Transact(ctx, func(tx *ManagedTx) error {
+		attempts = append(attempts, tx.Attempt())
+		tx.OnCommit(func(Commit) { committed = tx.Attempt() })
+		_, _, err := db.PutTx(tx, &memoryObj{ID: 1, Name: "a"})
+		return err
+	})
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2, 3}, attempts)
+	require.Equal(t, []int{1, 2}, backoffs)
+	// only the callbacks of the committed attempt are called
+	require.Equal(t, 3, committed)
+
+	// the conflict is returned after the maximum number of attempts
+	backend.aborts = 2
+	attempts = nil
+	_, err = db.Transact(ctx, func(tx *ManagedTx) error {
+		attempts = append(attempts, tx.Attempt())
+		tx.OnCommit(func(Commit) { t.Fatal("called OnCommit of an aborted transaction") })
+		return nil
+	}, WithRetries(1))
+	require.ErrorIs(t, err, datastore.ErrConcurrentTransaction)
+	require.Equal(t, []int{1, 2}, attempts)
+
+	// other errors are not retried
+	errAbort := errors.New("abort")
+	attempts = nil
+	_, err = db.Transact(ctx, func(tx *ManagedTx) error {
+		attempts = append(attempts, tx.Attempt())
+		return errAbort
+	})
+	require.ErrorIs(t, err, errAbort)
+	require.Equal(t, []int{1}, attempts)
+
+	// the methods of the DSEnt use the options too
+	backend.aborts = 1
+	backoffs = nil
+	_, _, err = db.BatchPut(ctx, []*memoryObj{{ID: 2, Name: "b"}})
+	require.NoError(t, err)
+	require.Equal(t, []int{1}, backoffs)
+}
+
+func TestTransactReadOnly(t *testing.T) {
+	ctx := context.Background()
+	db := newMemoryDSEnt[*memoryObj](t, "Memory")
+	_, _, err := db.Create(ctx, &memoryObj{ID: 1, Name: "a"})
+	require.NoError(t, err)
+
+	_, err = db.Transact(ctx, func(tx *ManagedTx) error {
+		obj, err := db.GetTx(tx, &memoryObj{ID: 1})
+		require.NoError(t, err)
+		require.Equal(t, "a", obj.Name)
+		_, _, err = db.PutTx(tx, obj)
+		return err
+	}, WithReadOnly())
+	require.ErrorIs(t, err, ErrReadOnlyTx)
+}
+
+func TestTransactConcurrent(t *testing.T) {
+	ctx := context.Background()
+	db := newMemoryDSEnt[*memoryObj](t, "Memory", WithCache(NewLRUCache(100, time.Minute)))
+
+	// the transaction is used by several goroutines, each registering callbacks
+	called := 0
+	_, err := db.Transact(ctx, func(tx *ManagedTx) error {
+		var wg sync.WaitGroup
+		errs := make([]error, 10)
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				tx.OnCommit(func(Commit) { called++ })
+				_, _, errs[i] = db.PutTx(tx, &memoryObj{ID: int64(i + 1), Name: "a"})
+			}(i)
+		}
+		wg.Wait()
+		return errors.Join(errs...)
+	})
+	require.NoError(t, err)
+	// every registered callback is called
+	require.Equal(t, 10, called)
+	n, err := db.Query().Count(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 10, n)
+}
+
+func TestTransactContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	backend := &abortBackend{MemoryBackend: NewMemoryBackend(), aborts: 1}
+	db := newDSEnt[*memoryObj](t, backend, "Memory", WithTxOptions(WithTxBackoff(func(int) time.Duration {
+		cancel()
+		return time.Hour
+	})))
+	_, err := db.RunInTransaction(ctx, func(tx Tx) error {
+		return nil
+	})
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	backoff := exponentialBackoff(time.Second, time.Hour)
+	require.Equal(t, time.Second, backoff(1))
+	require.Equal(t, 4*time.Second, backoff(3))
+	require.Equal(t, time.Hour, backoff(100))
+}
@@ -0,0 +1,186 @@
+package dsent
+
+import (
+	"context"
+	"errors"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrBackendMismatch is returned by UnitOfWork.Commit when the DSEnt instances
+// of the staged writes do not run against the same backend.
+var ErrBackendMismatch = errors.New("unit of work spans several backends")
+
+// ErrUnitOfWorkCommitted is returned by UnitOfWork.Commit when it has already committed.
+var ErrUnitOfWorkCommitted = errors.New("unit of work already committed")
+
+// UnitOfWork collects writes staged by several DSEnt instances, of any kind,
+// and applies them within a single transaction, e.g.
+//
+//	uow := dsent.NewUnitOfWork()
+//	orders.StageCreate(uow, order)
+//	items.StagePut(uow, items...)
+//	_, err := uow.Commit(ctx)
+//
+// The hooks run as for the batch methods: the Before* hooks once before the
+// transaction, the AfterSave hooks once after it has committed, and those of
+// StageUpdate within it. Once committed, the keys of the written objects are
+// resolved with ResolveKey, incomplete keys included.
+//
+// The transaction uses the default options of the first DSEnt that staged a
+// write, see WithTxOptions. Commit is traced by the tracer of that DSEnt, see
+// WithTracerProvider, with a "dsent.UnitOfWork" span that records the
+// dsent.operation and dsent.tx.attempt attributes.
+//
+// A UnitOfWork is not safe for concurrent use.
+type UnitOfWork struct {
+	backend   Backend
+	tracer    trace.Tracer
+	txOptions []TxOption
+	steps     []*unitStep
+	err       error
+	committed bool
+}
+
+// unitStep is a write staged in a UnitOfWork.
+type unitStep struct {
+	// prepare runs once before the transaction.
+	prepare func(ctx context.Context) error
+	// stage runs within every attempt of the transaction.
+	stage func(tx Tx) error
+	// finish runs once the transaction has committed.
+	finish func(ctx context.Context, cmt Commit) error
+}
+
+// NewUnitOfWork creates an empty UnitOfWork.
+func NewUnitOfWork() *UnitOfWork {
+	return &UnitOfWork{}
+}
+
+// add appends a step staged by a DSEnt running against backend, with the
+// given tracer and default transaction options.
+func (u *UnitOfWork) add(backend Backend, tracer trace.Tracer, txOptions []TxOption, step *unitStep) {
+	if u.backend == nil {
+		u.backend = backend
+		u.tracer = tracer
+		u.txOptions = txOptions
+	} else if backendIdentity(u.backend) != backendIdentity(backend) && u.err == nil {
+		u.err = ErrBackendMismatch
+	}
+	u.steps = append(u.steps, step)
+}
+
+// Commit applies the staged writes, in the order they were staged, within a
+// single transaction run with the given options, see Transact.
+// It returns the Commit of the transaction, or nil if nothing was staged.
+func (u *UnitOfWork) Commit(ctx context.Context, opts ...TxOption) (_ Commit, err error) {
+	if u.err != nil {
+		return nil, u.err
+	} else if u.committed {
+		return nil, ErrUnitOfWorkCommitted
+	} else if len(u.steps) == 0 {
+		return nil, nil
+	}
+	ctx, span := u.tracer.Start(ctx, "dsent.UnitOfWork", trace.WithAttributes(attrOperation.String("UnitOfWork")))
+	defer endSpan(span, &err)
+	for _, step := range u.steps {
+		if step.prepare == nil {
+			continue
+		}
+		if err := step.prepare(ctx); err != nil {
+			return nil, err
+		}
+	}
+	cmt, err := runTx(ctx, u.backend, func(tx *ManagedTx) error {
+		span.SetAttributes(attrTxAttempt.Int(tx.Attempt()))
+		for _, step := range u.steps {
+			if err := step.stage(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, newTxOptions(u.txOptions, opts))
+	if err != nil {
+		return nil, err
+	}
+	u.committed = true
+	var finishErr error
+	for _, step := range u.steps {
+		if err := step.finish(ctx, cmt); err != nil && finishErr == nil {
+			finishErr = err
+		}
+	}
+	return cmt, finishErr
+}
+
+// StageCreate stages the creation of objs in uow, see BatchCreate.
+func (db *DSEnt[T]) StageCreate(uow *UnitOfWork, objs ...T) {
+	db.stageWriteIn(uow, OpInsert, objs)
+}
+
+// StagePut stages the save of objs in uow, see BatchPut.
+func (db *DSEnt[T]) StagePut(uow *UnitOfWork, objs ...T) {
+	db.stageWriteIn(uow, OpUpsert, objs)
+}
+
+// stageWriteIn stages the write of objs in uow.
+func (db *DSEnt[T]) stageWriteIn(uow *UnitOfWork, op MutationOp, objs []T) {
+	var pks []*PendingKey
+	uow.add(db.backend, db.tracer, db.opts.txOptions, &unitStep{
+		prepare: func(ctx context.Context) error {
+			return db.prepareWrite(ctx, op, objs)
+		},
+		stage: func(tx Tx) error {
+			var err error
+			pks, err = db.stageWrite(tx, op, objs)
+			return err
+		},
+		finish: func(ctx context.Context, cmt Commit) error {
+			for i, pk := range pks {
+				if err := db.ResolveKey(cmt.Key(pk), objs[i]); err != nil {
+					return err
+				}
+			}
+			return db.afterSave(ctx, objs...)
+		},
+	})
+}
+
+// StageUpdate stages the update of an entity in uow, see UpdateTx.
+// obj is loaded in place: updateFunc and createFunc should modify the object
+// they are given and return it.
+func (db *DSEnt[T]) StageUpdate(
+	uow *UnitOfWork, obj T,
+	updateFunc func(T) (T, error),
+	createFunc func(T) (T, error),
+) {
+	written := false
+	uow.add(db.backend, db.tracer, db.opts.txOptions, &unitStep{
+		stage: func(tx Tx) error {
+			var err error
+			obj, written, err = db.updateTx(tx, obj, updateFunc, createFunc)
+			return err
+		},
+		finish: func(ctx context.Context, cmt Commit) error {
+			if !written {
+				return nil
+			}
+			return db.afterSave(ctx, obj)
+		},
+	})
+}
+
+// StageDelete stages the deletion of objs in uow, see BatchDelete.
+func (db *DSEnt[T]) StageDelete(uow *UnitOfWork, objs ...T) {
+	uow.add(db.backend, db.tracer, db.opts.txOptions, &unitStep{
+		prepare: func(ctx context.Context) error {
+			return db.beforeDelete(ctx, objs...)
+		},
+		stage: func(tx Tx) error {
+			return db.stageDelete(tx, objs)
+		},
+		finish: func(ctx context.Context, cmt Commit) error {
+			return nil
+		},
+	})
+}
@@ -0,0 +1,136 @@
+package dsent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestUnitOfWork(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemoryBackend()
+	memories := newDSEnt[*memoryObj](t, backend, "Memory")
+	hooks := newDSEnt[*hookObj](t, backend, "Hook")
+	_, _, err := memories.BatchCreate(ctx, []*memoryObj{{ID: 1, Name: "a"}, {ID: 2, Name: "b"}})
+	require.NoError(t, err)
+
+	uow := NewUnitOfWork()
+	created := &memoryObj{Name: "c"}
+	memories.StageCreate(uow, created)
+	hook := &hookObj{ID: 1, Name: "h"}
+	hooks.StagePut(uow, hook)
+	updated := &memoryObj{ID: 1}
+	memories.StageUpdate(uow, updated, func(obj *memoryObj) (*memoryObj, error) {
+		obj.Score++
+		return obj, nil
+	}, nil)
+	memories.StageDelete(uow, &memoryObj{ID: 2})
+	cmt, err := uow.Commit(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, cmt)
+
+	// the incomplete key was resolved
+	require.NotZero(t, created.ID)
+	_, err = memories.Get(ctx, &memoryObj{ID: created.ID})
+	require.NoError(t, err)
+	require.Equal(t, []string{"BeforeSave", "AfterSave"}, hook.calls)
+	require.Equal(t, "a", updated.Name)
+	obj, err := memories.Get(ctx, &memoryObj{ID: 1})
+	require.NoError(t, err)
+	require.Equal(t, 1, obj.Score)
+	ok, err := memories.Exists(ctx, &memoryObj{ID: 2})
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	_, err = uow.Commit(ctx)
+	require.ErrorIs(t, err, ErrUnitOfWorkCommitted)
+}
+
+func TestUnitOfWorkRollback(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemoryBackend()
+	memories := newDSEnt[*memoryObj](t, backend, "Memory")
+	hooks := newDSEnt[*hookObj](t, backend, "Hook")
+
+	// nothing is written if a write fails
+	uow := NewUnitOfWork()
+	hook := &hookObj{ID: 1, Name: "h"}
+	hooks.StageCreate(uow, hook)
+	memories.StageUpdate(uow, &memoryObj{ID: 1}, func(obj *memoryObj) (*memoryObj, error) {
+		return obj, nil
+	}, nil)
+	_, err := uow.Commit(ctx)
+	require.ErrorIs(t, err, ErrNotFound)
+	require.Equal(t, []string{"BeforeCreate", "BeforeSave"}, hook.calls)
+	ok, err := hooks.Exists(ctx, &hookObj{ID: 1})
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// nor if a hook fails
+	uow = NewUnitOfWork()
+	memories.StagePut(uow, &memoryObj{ID: 1})
+	hooks.StagePut(uow, &hookObj{ID: 1, fail: "BeforeSave"})
+	_, err = uow.Commit(ctx)
+	require.ErrorIs(t, err, errHook)
+	ok, err = memories.Exists(ctx, &memoryObj{ID: 1})
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// all the DSEnt instances must share their backend
+	uow = NewUnitOfWork()
+	memories.StagePut(uow, &memoryObj{ID: 1})
+	newMemoryDSEnt[*hookObj](t, "Hook").StagePut(uow, &hookObj{ID: 1})
+	_, err = uow.Commit(ctx)
+	require.ErrorIs(t, err, ErrBackendMismatch)
+
+	cmt, err := NewUnitOfWork().Commit(ctx)
+	require.NoError(t, err)
+	require.Nil(t, cmt)
+}
+
+func TestUnitOfWorkClientBackend(t *testing.T) {
+	// the DSEnt instances of the same client share their backend, although
+	// NewClientBackend creates a Backend per call
+	client := &datastore.Client{}
+	memories := NewDSEntWithBackend[*memoryObj](NewClientBackend(client), "", "Memory", WithRegistry(NewRegistry()))
+	hooks := NewDSEntWithBackend[*hookObj](NewClientBackend(client), "", "Hook", WithRegistry(NewRegistry()))
+	uow := NewUnitOfWork()
+	memories.StagePut(uow, &memoryObj{ID: 1})
+	hooks.StagePut(uow, &hookObj{ID: 1})
+	require.NoError(t, uow.err)
+}
+
+func TestUnitOfWorkOptions(t *testing.T) {
+	ctx := context.Background()
+	rec := tracetest.NewSpanRecorder()
+	backend := &abortBackend{MemoryBackend: NewMemoryBackend()}
+	var backoffs []int
+	memories := newDSEnt[*memoryObj](t, backend, "Memory",
+		WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))),
+		WithTxOptions(WithTxBackoff(func(attempt int) time.Duration {
+			backoffs = append(backoffs, attempt)
+			return 0
+		})))
+	hooks := newDSEnt[*hookObj](t, backend, "Hook")
+
+	// the transaction uses the options and the tracer of the first DSEnt
+	backend.aborts = 1
+	uow := NewUnitOfWork()
+	memories.StagePut(uow, &memoryObj{ID: 1})
+	hooks.StagePut(uow, &hookObj{ID: 1})
+	_, err := uow.Commit(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []int{1}, backoffs)
+
+	spans := rec.Ended()
+	require.Len(t, spans, 1)
+	require.Equal(t, "dsent.UnitOfWork", spans[0].Name())
+	attrs := spanAttrs(spans[0])
+	require.Equal(t, "UnitOfWork", attrs[attrOperation].AsString())
+	require.Equal(t, int64(2), attrs[attrTxAttempt].AsInt64())
+}
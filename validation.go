@@ -0,0 +1,115 @@
+package dsent
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+)
+
+// ErrInvalidEntity is matched by every ValidationError.
+var ErrInvalidEntity = errors.New("invalid entity")
+
+// Validator is implemented by objects that validate themselves.
+// DSEnt runs Validate before every insert, upsert and update, including the
+// batch, bulk and *Tx variants, after the BeforeSave hook. The write is
+// aborted with a *ValidationError if Validate returns an error.
+type Validator interface {
+	Validate() error
+}
+
+// FieldError is a problem with a single field of an object.
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ValidationError is returned when an object fails validation.
+//
+// Validate methods can build one with Add and return it with Err, e.g.
+//
+//	var verr dsent.ValidationError
+//	if x.Email == "" {
+//		verr.Add("email", "is required")
+//	}
+//	return verr.Err()
+//
+// Other errors returned by Validate are wrapped into a ValidationError.
+type ValidationError struct {
+	// Kind and Key identify the invalid entity, they are set by DSEnt.
+	// Key is nil if it could not be built.
+	Kind string
+	Key  *datastore.Key
+	// Fields lists the problems with the fields of the object.
+	Fields []FieldError
+	// Cause is the error returned by Validate when it is not a ValidationError.
+	Cause error
+}
+
+// Add records a problem with a field.
+func (e *ValidationError) Add(field, format string, args ...interface{}) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Err returns e if problems were recorded, nil otherwise.
+func (e *ValidationError) Err() error {
+	if len(e.Fields) == 0 && e.Cause == nil {
+		return nil
+	}
+	return e
+}
+
+func (e *ValidationError) Error() string {
+	var b strings.Builder
+	b.WriteString(ErrInvalidEntity.Error())
+	if e.Kind != "" {
+		b.WriteString(" " + e.Kind)
+	}
+	if e.Key != nil && !e.Key.Incomplete() {
+		b.WriteString(" " + e.Key.String())
+	}
+	b.WriteString(": ")
+	problems := make([]string, 0, len(e.Fields)+1)
+	for _, f := range e.Fields {
+		problems = append(problems, f.Error())
+	}
+	if e.Cause != nil {
+		problems = append(problems, e.Cause.Error())
+	}
+	b.WriteString(strings.Join(problems, "; "))
+	return b.String()
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrInvalidEntity
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Cause
+}
+
+// validate runs the Validate method of obj, if any.
+func (db *DSEnt[T]) validate(obj T) error {
+	v, ok := interface{}(obj).(Validator)
+	if !ok {
+		return nil
+	}
+	err := v.Validate()
+	if err == nil {
+		return nil
+	}
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		verr = &ValidationError{Cause: err}
+	}
+	verr.Kind = db.kind
+	if key, kerr := obj.BuildKey(db.namespace); kerr == nil {
+		verr.Key = key
+	}
+	return verr
+}
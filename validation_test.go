@@ -0,0 +1,93 @@
+package dsent
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+var _ Validator = (*validObj)(nil)
+
+type validObj struct {
+	ID    int64  `datastore:"-"`
+	Name  string `datastore:"name"`
+	Age   int    `datastore:"age"`
+	Cause error  `datastore:"-"`
+}
+
+func (x *validObj) BuildKey(ns string) (*datastore.Key, error) {
+	return SetNS(datastore.IDKey("Valid", x.ID, nil), ns), nil
+}
+
+func (x *validObj) Load(ps []datastore.Property) error {
+	return datastore.LoadStruct(x, ps)
+}
+
+func (x *validObj) Save() ([]datastore.Property, error) {
+	return datastore.SaveStruct(x)
+}
+
+func (x *validObj) Validate() error {
+	if x.Cause != nil {
+		return x.Cause
+	}
+	var verr ValidationError
+	if x.Name == "" {
+		verr.Add("name", "is required")
+	}
+	if x.Age < 0 {
+		verr.Add("age", "must not be negative, got %d", x.Age)
+	}
+	return verr.Err()
+}
+
+func TestValidation(t *testing.T) {
+	ctx := context.Background()
+	db := newMemoryDSEnt[*validObj](t, "Valid")
+
+	_, _, err := db.Create(ctx, &validObj{ID: 1, Age: -1})
+	require.ErrorIs(t, err, ErrInvalidEntity)
+	var verr *ValidationError
+	require.ErrorAs(t, err, &verr)
+	require.Equal(t, "Valid", verr.Kind)
+	require.Equal(t, int64(1), verr.Key.ID)
+	require.Equal(t, []FieldError{
+		{Field: "name", Message: "is required"},
+		{Field: "age", Message: "must not be negative, got -1"},
+	}, verr.Fields)
+	require.Equal(t, "invalid entity Valid /Valid,1: name: is required; age: must not be negative, got -1", err.Error())
+
+	cause := errors.New("custom")
+	_, _, err = db.Put(ctx, &validObj{ID: 1, Cause: cause})
+	require.ErrorIs(t, err, ErrInvalidEntity)
+	require.ErrorIs(t, err, cause)
+
+	_, _, err = db.BatchCreate(ctx, []*validObj{{ID: 1, Name: "a"}, {ID: 2}})
+	require.ErrorIs(t, err, ErrInvalidEntity)
+	_, _, err = db.BulkPut(ctx, []*validObj{{ID: 1, Name: "a"}, {ID: 2}})
+	require.ErrorIs(t, err, ErrInvalidEntity)
+	n, err := db.Query().Count(ctx)
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	_, _, err = db.Create(ctx, &validObj{ID: 1, Name: "a"})
+	require.NoError(t, err)
+	_, err = db.Update(ctx, &validObj{ID: 1}, func(x *validObj) (*validObj, error) {
+		x.Name = ""
+		return x, nil
+	}, nil)
+	require.ErrorIs(t, err, ErrInvalidEntity)
+	_, err = db.RunInTransaction(ctx, func(tx Tx) error {
+		_, _, err := db.PutTx(tx, &validObj{ID: 1, Age: -2, Name: "b"})
+		return err
+	})
+	require.ErrorIs(t, err, ErrInvalidEntity)
+
+	obj, err := db.Get(ctx, &validObj{ID: 1})
+	require.NoError(t, err)
+	require.Equal(t, "a", obj.Name)
+	require.Zero(t, obj.Age)
+}
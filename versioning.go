@@ -0,0 +1,221 @@
+package dsent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"cloud.google.com/go/datastore"
+)
+
+// ErrVersionConflict is matched by every VersionConflictError.
+var ErrVersionConflict = errors.New("version conflict")
+
+// ErrNotVersioned is returned by PutIfVersion and UpdateIfVersion when the
+// objects of the DSEnt do not implement Versioned.
+var ErrNotVersioned = errors.New("object does not implement Versioned")
+
+// Versioned is implemented by objects with a version property managed by DSEnt,
+// for optimistic concurrency control across requests.
+//
+// Every write sets the version of the object to the version of the stored
+// entity plus 1, read within the transaction of the write, so that a new entity
+// has version 1 and versions never go back, whatever the version of the written
+// object. Create, Put and every chunk of BulkCreate and BulkPut then run in a
+// transaction. The version is set once the hooks and validation passed.
+//
+// PutIfVersion and UpdateIfVersion only write an entity if its stored version
+// is the one the caller read. The version must be stored as a property of the
+// entity, e.g.
+//
+//	type User struct {
+//		Version int64 `datastore:"version"`
+//	}
+//
+//	func (u *User) EntityVersion() int64     { return u.Version }
+//	func (u *User) SetEntityVersion(v int64) { u.Version = v }
+type Versioned interface {
+	EntityVersion() int64
+	SetEntityVersion(v int64)
+}
+
+// VersionConflictError is returned when the stored version of an entity is not
+// the one expected by PutIfVersion or UpdateIfVersion.
+type VersionConflictError struct {
+	Kind string
+	Key  *datastore.Key
+	// Expected is the version given by the caller.
+	Expected int64
+	// Actual is the stored version, 0 if the entity does not exist.
+	Actual int64
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("%v: %s %v: expected version %d, got %d", ErrVersionConflict, e.Kind, e.Key, e.Expected, e.Actual)
+}
+
+func (e *VersionConflictError) Is(target error) bool {
+	return target == ErrVersionConflict
+}
+
+// versioned reports whether the objects of the DSEnt are Versioned.
+func (db *DSEnt[T]) versioned() bool {
+	var obj T
+	_, ok := interface{}(obj).(Versioned)
+	return ok
+}
+
+// versionTx reads the entities stored for keys within tx, if the DSEnt audits
+// its writes or its objects are Versioned, and sets the versions of objs from
+// them. It returns the snapshots of the entities for auditTx, see snapshotTx.
+func (db *DSEnt[T]) versionTx(tx Tx, keys []*datastore.Key, objs []T) ([][]datastore.Property, error) {
+	if !db.audited() && !db.versioned() {
+		return nil, nil
+	}
+	stored, err := db.readTx(tx, keys)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.setVersions(objs, stored); err != nil {
+		return nil, err
+	}
+	if !db.audited() {
+		return nil, nil
+	}
+	return stored, nil
+}
+
+// setVersions sets the version of every object to the version of its stored
+// entity plus 1, if the objects are Versioned. stored holds the properties of
+// the stored entities, nil for those that do not exist, or is nil if none does.
+func (db *DSEnt[T]) setVersions(objs []T, stored [][]datastore.Property) error {
+	if !db.versioned() {
+		return nil
+	}
+	for i, obj := range objs {
+		var version int64
+		if stored != nil && stored[i] != nil {
+			s := newObject[T]()
+			if err := s.Load(stored[i]); !loaded(err) {
+				return err
+			}
+			version = interface{}(s).(Versioned).EntityVersion()
+		}
+		interface{}(obj).(Versioned).SetEntityVersion(version + 1)
+	}
+	return nil
+}
+
+// bumpVersion increments the version of obj, loaded within the transaction of
+// the write, if it is Versioned.
+func (db *DSEnt[T]) bumpVersion(obj T) {
+	if v, ok := interface{}(obj).(Versioned); ok {
+		v.SetEntityVersion(v.EntityVersion() + 1)
+	}
+}
+
+// checkVersion returns a *VersionConflictError unless the entity stored for key
+// within tx has the given version.
+func (db *DSEnt[T]) checkVersion(tx Tx, key *datastore.Key, version int64) error {
+	stored := newObject[T]()
+	var actual int64
+	if err := tx.Get(key, stored); loaded(err) {
+		actual = interface{}(stored).(Versioned).EntityVersion()
+	} else if err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	if actual != version {
+		return &VersionConflictError{Kind: db.kind, Key: key, Expected: version, Actual: actual}
+	}
+	return nil
+}
+
+// PutIfVersion saves obj like Put, only if the stored entity has the given
+// version, or does not exist and version is 0. Otherwise it returns a
+// *VersionConflictError. The version of obj is set to version+1.
+//
+// The stored version is read and the entity written within a transaction.
+func (db *DSEnt[T]) PutIfVersion(ctx context.Context, obj T, version int64) (_ *datastore.Key, _ T, err error) {
+	ctx, span := db.startSpan(ctx, "PutIfVersion", 1)
+	defer endSpan(span, &err)
+	if _, ok := interface{}(obj).(Versioned); !ok {
+		return nil, obj, ErrNotVersioned
+	}
+	if err := db.prepareWrite(ctx, OpUpsert, []T{obj}); err != nil {
+		return nil, obj, err
+	}
+	key, err := obj.BuildKey(db.namespace)
+	if err != nil {
+		return nil, obj, err
+	}
+	if _, err := db.runInTransaction(ctx, func(tx Tx) error {
+		if err := db.checkVersion(tx, key, version); err != nil {
+			return err
+		}
+		_, err := db.stageWrite(tx, OpUpsert, []T{obj})
+		return err
+	}); err != nil {
+		return nil, obj, err
+	}
+	if err := db.ResolveKey(key, obj); err != nil {
+		return key, obj, err
+	}
+	return key, obj, db.afterSave(ctx, obj)
+}
+
+// PutIfVersionTx is like PutIfVersion but within a transaction.
+func (db *DSEnt[T]) PutIfVersionTx(tx Tx, obj T, version int64) (_ *PendingKey, _ T, err error) {
+	span := db.startSpanTx(tx, "PutIfVersionTx", 1)
+	defer endSpan(span, &err)
+	if _, ok := interface{}(obj).(Versioned); !ok {
+		return nil, obj, ErrNotVersioned
+	}
+	if err := db.prepareWrite(tx.Context(), OpUpsert, []T{obj}); err != nil {
+		return nil, obj, err
+	}
+	key, err := obj.BuildKey(db.namespace)
+	if err != nil {
+		return nil, obj, err
+	}
+	if err := db.checkVersion(tx, key, version); err != nil {
+		return nil, obj, err
+	}
+	pks, err := db.stageWrite(tx, OpUpsert, []T{obj})
+	if err != nil {
+		return nil, obj, err
+	}
+	return pks[0], obj, db.afterSave(tx.Context(), obj)
+}
+
+// UpdateIfVersion updates an entity like Update, only if the stored entity has
+// the given version. Otherwise it returns a *VersionConflictError without
+// calling updateFunc. The entity must exist.
+func (db *DSEnt[T]) UpdateIfVersion(ctx context.Context, obj T, version int64, updateFunc func(T) (T, error)) (_ T, err error) {
+	ctx, span := db.startSpan(ctx, "UpdateIfVersion", 1)
+	defer endSpan(span, &err)
+	if _, ok := interface{}(obj).(Versioned); !ok {
+		return obj, ErrNotVersioned
+	}
+	return db.update(ctx, obj, db.ifVersion(version, updateFunc), nil)
+}
+
+// UpdateIfVersionTx is like UpdateIfVersion but within a transaction.
+func (db *DSEnt[T]) UpdateIfVersionTx(tx Tx, obj T, version int64, updateFunc func(T) (T, error)) (_ T, err error) {
+	span := db.startSpanTx(tx, "UpdateIfVersionTx", 1)
+	defer endSpan(span, &err)
+	if _, ok := interface{}(obj).(Versioned); !ok {
+		return obj, ErrNotVersioned
+	}
+	return db.updateSaveTx(tx, obj, db.ifVersion(version, updateFunc), nil)
+}
+
+// ifVersion wraps updateFunc to only call it if the loaded object has the given version.
+func (db *DSEnt[T]) ifVersion(version int64, updateFunc func(T) (T, error)) func(T) (T, error) {
+	return func(obj T) (T, error) {
+		if actual := interface{}(obj).(Versioned).EntityVersion(); actual != version {
+			key, _ := obj.BuildKey(db.namespace)
+			return obj, &VersionConflictError{Kind: db.kind, Key: key, Expected: version, Actual: actual}
+		}
+		return updateFunc(obj)
+	}
+}
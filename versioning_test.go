@@ -0,0 +1,180 @@
+package dsent
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+var _ Versioned = (*versionedObj)(nil)
+
+type versionedObj struct {
+	ID      int64  `datastore:"-"`
+	Name    string `datastore:"name"`
+	Version int64  `datastore:"version"`
+
+	// invalid makes Validate fail.
+	invalid bool
+}
+
+func (x *versionedObj) BuildKey(ns string) (*datastore.Key, error) {
+	return SetNS(datastore.IDKey("Versioned", x.ID, nil), ns), nil
+}
+
+func (x *versionedObj) Load(ps []datastore.Property) error {
+	return datastore.LoadStruct(x, ps)
+}
+
+func (x *versionedObj) Save() ([]datastore.Property, error) {
+	return datastore.SaveStruct(x)
+}
+
+func (x *versionedObj) EntityVersion() int64 {
+	return x.Version
+}
+
+func (x *versionedObj) SetEntityVersion(v int64) {
+	x.Version = v
+}
+
+func (x *versionedObj) Validate() error {
+	if x.invalid {
+		return errors.New("invalid")
+	}
+	return nil
+}
+
+func TestVersioning(t *testing.T) {
+	ctx := context.Background()
+	db := newMemoryDSEnt[*versionedObj](t, "Versioned")
+
+	// every write increments the version
+	_, obj, err := db.Create(ctx, &versionedObj{ID: 1, Name: "a"})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), obj.Version)
+	obj.Name = "b"
+	_, obj, err = db.Put(ctx, obj)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), obj.Version)
+
+	_, obj, err = db.PutIfVersion(ctx, &versionedObj{ID: 1, Name: "c"}, 2)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), obj.Version)
+
+	_, _, err = db.PutIfVersion(ctx, &versionedObj{ID: 1, Name: "d"}, 2)
+	require.ErrorIs(t, err, ErrVersionConflict)
+	var verr *VersionConflictError
+	require.ErrorAs(t, err, &verr)
+	require.Equal(t, &VersionConflictError{Kind: "Versioned", Key: datastore.IDKey("Versioned", 1, nil), Expected: 2, Actual: 3}, verr)
+
+	// version 0 expects the entity not to exist
+	_, obj, err = db.PutIfVersion(ctx, &versionedObj{ID: 2, Name: "new"}, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), obj.Version)
+	_, _, err = db.PutIfVersion(ctx, &versionedObj{ID: 2}, 0)
+	require.ErrorIs(t, err, ErrVersionConflict)
+
+	obj, err = db.UpdateIfVersion(ctx, &versionedObj{ID: 1}, 3, func(x *versionedObj) (*versionedObj, error) {
+		x.Name = "e"
+		return x, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(4), obj.Version)
+	called := false
+	_, err = db.UpdateIfVersion(ctx, &versionedObj{ID: 1}, 3, func(x *versionedObj) (*versionedObj, error) {
+		called = true
+		return x, nil
+	})
+	require.ErrorIs(t, err, ErrVersionConflict)
+	require.False(t, called)
+
+	_, err = db.RunInTransaction(ctx, func(tx Tx) error {
+		if _, _, err := db.PutIfVersionTx(tx, &versionedObj{ID: 2, Name: "f"}, 1); err != nil {
+			return err
+		}
+		_, err := db.UpdateIfVersionTx(tx, &versionedObj{ID: 1}, 4, func(x *versionedObj) (*versionedObj, error) {
+			x.Name = "f"
+			return x, nil
+		})
+		return err
+	})
+	require.NoError(t, err)
+	objs, err := db.BatchGet(ctx, []*versionedObj{{ID: 1}, {ID: 2}})
+	require.NoError(t, err)
+	require.Equal(t, []*versionedObj{{ID: 1, Name: "f", Version: 5}, {ID: 2, Name: "f", Version: 2}}, objs)
+
+	// a failed conditional write in a transaction aborts it
+	_, err = db.RunInTransaction(ctx, func(tx Tx) error {
+		if _, _, err := db.PutTx(tx, &versionedObj{ID: 3}); err != nil {
+			return err
+		}
+		_, _, err := db.PutIfVersionTx(tx, &versionedObj{ID: 2}, 1)
+		return err
+	})
+	require.ErrorIs(t, err, ErrVersionConflict)
+	ok, err := db.Exists(ctx, &versionedObj{ID: 3})
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	_, _, err = newMemoryDSEnt[*memoryObj](t, "Memory").PutIfVersion(ctx, &memoryObj{ID: 1}, 0)
+	require.ErrorIs(t, err, ErrNotVersioned)
+}
+
+func TestVersioningRetry(t *testing.T) {
+	ctx := context.Background()
+	db := newDSEnt[*versionedObj](t, &conflictBackend{MemoryBackend: NewMemoryBackend()}, "Versioned")
+
+	// versions are incremented once, not once per attempt of the transaction
+	_, objs, err := db.BatchCreate(ctx, []*versionedObj{{ID: 1}})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), objs[0].Version)
+	_, obj, err := db.PutIfVersion(ctx, objs[0], 1)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), obj.Version)
+	obj, err = db.Get(ctx, &versionedObj{ID: 1})
+	require.NoError(t, err)
+	require.Equal(t, int64(2), obj.Version)
+}
+
+func TestVersioningBlindWrites(t *testing.T) {
+	ctx := context.Background()
+	db := newMemoryDSEnt[*versionedObj](t, "Versioned")
+	for i := 0; i < 3; i++ {
+		_, _, err := db.Put(ctx, &versionedObj{ID: 1})
+		require.NoError(t, err)
+	}
+
+	// writes follow the stored version, not the one of the written object
+	_, obj, err := db.Put(ctx, &versionedObj{ID: 1, Name: "a"})
+	require.NoError(t, err)
+	require.Equal(t, int64(4), obj.Version)
+	_, objs, err := db.BulkPut(ctx, []*versionedObj{{ID: 1, Version: 10}, {ID: 2, Version: 10}})
+	require.NoError(t, err)
+	require.Equal(t, int64(5), objs[0].Version)
+	require.Equal(t, int64(1), objs[1].Version)
+	_, err = db.RunInTransaction(ctx, func(tx Tx) error {
+		_, obj, err = db.PutTx(tx, &versionedObj{ID: 1})
+		return err
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(6), obj.Version)
+	stored, err := db.Get(ctx, &versionedObj{ID: 1})
+	require.NoError(t, err)
+	require.Equal(t, int64(6), stored.Version)
+
+	// so a stale version conflicts
+	_, _, err = db.PutIfVersion(ctx, &versionedObj{ID: 1}, 1)
+	require.ErrorIs(t, err, ErrVersionConflict)
+
+	// a rejected write leaves the object unchanged
+	obj = &versionedObj{ID: 1, Version: 6, invalid: true}
+	_, _, err = db.Put(ctx, obj)
+	require.ErrorIs(t, err, ErrInvalidEntity)
+	require.Equal(t, int64(6), obj.Version)
+	_, _, err = db.PutIfVersion(ctx, obj, 6)
+	require.ErrorIs(t, err, ErrInvalidEntity)
+	require.Equal(t, int64(6), obj.Version)
+}